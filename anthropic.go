@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AnthropicAPIVersion is the Messages API version sent with every request
+const AnthropicAPIVersion = "2023-06-01"
+
+// AnthropicClient implements LLMClient for the Anthropic Messages API
+type AnthropicClient struct {
+	APIKey     string
+	Model      string
+	URL        string
+	HTTPClient *http.Client
+}
+
+// anthropicRequest is the body of a Messages API request
+type anthropicRequest struct {
+	Model      string               `json:"model"`
+	MaxTokens  int                  `json:"max_tokens"`
+	System     string               `json:"system,omitempty"`
+	Messages   []anthropicMessage   `json:"messages"`
+	Stream     bool                 `json:"stream,omitempty"`
+	Tools      []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// anthropicTool describes a tool whose input schema structures the answer
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// anthropicToolChoice forces the model to answer through a specific tool
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// anthropicCommandTool is the tool Claude fills in with a CommandResponse
+const anthropicCommandTool = "propose_command"
+
+// anthropicMessage is a single conversation turn
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// anthropicResponse is the body of a successful Messages API response
+type anthropicResponse struct {
+	Content []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+}
+
+// anthropicStreamEvent is the data of a server-sent event in a streamed
+// Messages API response
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// GenerateCommand implements LLMClient for Anthropic
+func (c *AnthropicClient) GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generatePrompt(request))
+}
+
+// RepairCommand implements LLMClient for Anthropic
+func (c *AnthropicClient) RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generateRepairPrompt(repair))
+}
+
+// ExplainCommand implements LLMClient for Anthropic
+func (c *AnthropicClient) ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error) {
+	return c.complete(ctx, generateExplainPrompt(explain), false)
+}
+
+// StreamCommand implements StreamingLLMClient for Anthropic
+func (c *AnthropicClient) StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generatePrompt(request), onText))
+}
+
+// StreamRepair implements StreamingLLMClient for Anthropic
+func (c *AnthropicClient) StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generateRepairPrompt(repair), onText))
+}
+
+// generate sends a prompt to Anthropic and parses the command response
+func (c *AnthropicClient) generate(ctx context.Context, prompt *Prompt) (*CommandResponse, error) {
+	return commandResponse(c.complete(ctx, prompt, true))
+}
+
+// newRequest builds a Messages API request. If structured is set, the model
+// is made to answer through the propose_command tool.
+func (c *AnthropicClient) newRequest(ctx context.Context, prompt *Prompt, structured bool, stream bool) (*http.Request, error) {
+	requestBody := anthropicRequest{
+		Model:     c.Model,
+		MaxTokens: 1024,
+		System:    prompt.System,
+		Stream:    stream,
+	}
+	for _, msg := range prompt.Messages {
+		requestBody.Messages = append(requestBody.Messages, anthropicMessage{Role: msg.Role, Content: msg.Content})
+	}
+	if structured {
+		requestBody.Tools = []anthropicTool{{
+			Name:        anthropicCommandTool,
+			Description: "Propose a shell command for the user's request",
+			InputSchema: commandResponseSchema,
+		}}
+		requestBody.ToolChoice = &anthropicToolChoice{Type: "tool", Name: anthropicCommandTool}
+	}
+
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(c.URL, "/")+"/v1/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.APIKey)
+	req.Header.Set("anthropic-version", AnthropicAPIVersion)
+	return req, nil
+}
+
+// complete sends a prompt to Anthropic and returns the response text, or the
+// tool input if structured is set
+func (c *AnthropicClient) complete(ctx context.Context, prompt *Prompt, structured bool) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Anthropic", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, structured, false)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("unexpected response format from Anthropic: %v", err)
+	}
+
+	if err := anthropicStopError(response.StopReason); err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for _, block := range response.Content {
+		switch block.Type {
+		case "tool_use":
+			return string(block.Input), nil
+		case "text":
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("unexpected response format from Anthropic")
+	}
+
+	return text.String(), nil
+}
+
+// stream sends a prompt for a structured answer to Anthropic and reads the
+// tool input as it is generated from server-sent events
+func (c *AnthropicClient) stream(ctx context.Context, prompt *Prompt, onText func(string)) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Anthropic", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, true, true)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var input, text strings.Builder
+	stopReason := ""
+	err = readSSE(resp.Body, func(data string) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("unexpected response format from Anthropic: %v", err)
+		}
+		switch event.Type {
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "input_json_delta":
+				input.WriteString(event.Delta.PartialJSON)
+				onText(event.Delta.PartialJSON)
+			case "text_delta":
+				text.WriteString(event.Delta.Text)
+			}
+		case "message_delta":
+			stopReason = event.Delta.StopReason
+		case "message_stop":
+			return errStreamDone
+		case "error":
+			return &APIError{Provider: "Anthropic", Code: event.Error.Type, Message: event.Error.Message}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := anthropicStopError(stopReason); err != nil {
+		return "", err
+	}
+	if input.Len() > 0 {
+		return input.String(), nil
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("unexpected response format from Anthropic")
+	}
+	return text.String(), nil
+}
+
+// anthropicStopError reports stop reasons that leave no usable answer
+func anthropicStopError(stopReason string) error {
+	switch stopReason {
+	case "max_tokens":
+		return fmt.Errorf("Anthropic response was truncated at the token limit")
+	case "refusal":
+		return &APIError{Provider: "Anthropic", Kind: APIErrorBlocked, Code: stopReason, Message: "the model declined to answer this request"}
+	}
+	return nil
+}
+
+// GetProviderInfo returns provider and model information for Anthropic
+func (c *AnthropicClient) GetProviderInfo() string {
+	return fmt.Sprintf("Anthropic (%s)", c.Model)
+}
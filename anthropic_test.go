@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestAnthropicClient returns a client for a fake Messages API served by
+// handler
+func newTestAnthropicClient(t *testing.T, handler http.HandlerFunc) *AnthropicClient {
+	t.Helper()
+	// Building a prompt loads the config, which is created if missing
+	t.Setenv("HOME", t.TempDir())
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &AnthropicClient{APIKey: "test-key", Model: "test-model", URL: server.URL + "/", HTTPClient: server.Client()}
+}
+
+func TestAnthropicClientRequest(t *testing.T) {
+	client := newTestAnthropicClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("path = %q, want /v1/messages", r.URL.Path)
+		}
+		if got := r.Header.Get("anthropic-version"); got != AnthropicAPIVersion {
+			t.Errorf("anthropic-version = %q, want %q", got, AnthropicAPIVersion)
+		}
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("x-api-key = %q, want test-key", got)
+		}
+
+		var body anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("could not decode request: %v", err)
+		}
+		if body.Model != "test-model" || body.MaxTokens <= 0 || body.System == "" {
+			t.Errorf("request model = %q, max_tokens = %d, system set = %t", body.Model, body.MaxTokens, body.System != "")
+		}
+		if body.ToolChoice == nil || body.ToolChoice.Name != anthropicCommandTool {
+			t.Errorf("tool_choice = %+v, want %s", body.ToolChoice, anthropicCommandTool)
+		}
+		if len(body.Messages) != 1 || body.Messages[0].Role != "user" || !strings.Contains(body.Messages[0].Content, "list files") {
+			t.Errorf("messages = %+v, want one user message with the request", body.Messages)
+		}
+
+		fmt.Fprint(w, `{"content":[{"type":"tool_use","name":"propose_command","input":{"command":"ls -la","explanation":"lists files"}}],"stop_reason":"tool_use"}`)
+	})
+
+	response, err := client.GenerateCommand(context.Background(), &CommandRequest{Request: "list files"})
+	if err != nil {
+		t.Fatalf("GenerateCommand failed: %v", err)
+	}
+	if response.Command != "ls -la" || response.Explanation != "lists files" {
+		t.Errorf("GenerateCommand = %+v, want ls -la", response)
+	}
+}
+
+func TestAnthropicClientStream(t *testing.T) {
+	client := newTestAnthropicClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{
+			`{"type":"message_start"}`,
+			`{"type":"content_block_delta","delta":{"type":"input_json_delta","partial_json":"{\"command\":"}}`,
+			`{"type":"content_block_delta","delta":{"type":"input_json_delta","partial_json":"\"pwd\"}"}}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", data)
+		}
+	})
+
+	var streamed strings.Builder
+	response, err := client.StreamCommand(context.Background(), &CommandRequest{Request: "where am I"}, func(text string) {
+		streamed.WriteString(text)
+	})
+	if err != nil {
+		t.Fatalf("StreamCommand failed: %v", err)
+	}
+	if response.Command != "pwd" {
+		t.Errorf("StreamCommand command = %q, want pwd", response.Command)
+	}
+	if streamed.String() != `{"command":"pwd"}` {
+		t.Errorf("streamed text = %q", streamed.String())
+	}
+}
+
+func TestAnthropicClientErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		stream bool
+		// kind is the expected APIError kind, or -1 if the error is not an
+		// APIError
+		kind    APIErrorKind
+		message string
+	}{
+		{
+			name:    "invalid key",
+			status:  http.StatusUnauthorized,
+			body:    `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`,
+			kind:    APIErrorAuth,
+			message: "Anthropic rejected the API key (401 authentication_error): invalid x-api-key",
+		},
+		{
+			name:    "bad request",
+			status:  http.StatusBadRequest,
+			body:    `{"type":"error","error":{"type":"invalid_request_error","message":"model: not found"}}`,
+			kind:    APIErrorOther,
+			message: "Anthropic API error (400 invalid_request_error): model: not found",
+		},
+		{
+			name:    "error body that is not JSON",
+			status:  http.StatusForbidden,
+			body:    "forbidden by proxy",
+			kind:    APIErrorAuth,
+			message: "Anthropic rejected the API key (403): forbidden by proxy",
+		},
+		{
+			name:    "overloaded while streaming",
+			status:  http.StatusOK,
+			body:    `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			stream:  true,
+			kind:    APIErrorOther,
+			message: "Anthropic API error (overloaded_error): Overloaded",
+		},
+		{
+			name:    "refusal",
+			status:  http.StatusOK,
+			body:    `{"content":[],"stop_reason":"refusal"}`,
+			kind:    APIErrorBlocked,
+			message: "Anthropic blocked the response (refusal): the model declined to answer this request",
+		},
+		{
+			name:    "refusal while streaming",
+			status:  http.StatusOK,
+			body:    `{"type":"message_delta","delta":{"stop_reason":"refusal"}}`,
+			stream:  true,
+			kind:    APIErrorBlocked,
+			message: "Anthropic blocked the response (refusal): the model declined to answer this request",
+		},
+		{
+			name:    "truncated answer",
+			status:  http.StatusOK,
+			body:    `{"content":[{"type":"tool_use","input":{"command":"ls"}}],"stop_reason":"max_tokens"}`,
+			kind:    -1,
+			message: "Anthropic response was truncated at the token limit",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			client := newTestAnthropicClient(t, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if tt.stream {
+					w.Header().Set("Content-Type", "text/event-stream")
+					w.WriteHeader(tt.status)
+					fmt.Fprintf(w, "data: %s\n\ndata: {\"type\":\"message_stop\"}\n\n", tt.body)
+					return
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+
+			request := &CommandRequest{Request: "list files"}
+			var err error
+			if tt.stream {
+				_, err = client.StreamCommand(context.Background(), request, func(string) {})
+			} else {
+				_, err = client.GenerateCommand(context.Background(), request)
+			}
+			if err == nil {
+				t.Fatal("request succeeded, want an error")
+			}
+			if err.Error() != tt.message {
+				t.Errorf("error = %q, want %q", err, tt.message)
+			}
+
+			var apiErr *APIError
+			switch {
+			case tt.kind < 0 && errors.As(err, &apiErr):
+				t.Errorf("error is an APIError of kind %d, want a plain error", apiErr.Kind)
+			case tt.kind >= 0 && !errors.As(err, &apiErr):
+				t.Errorf("error is %T, want an APIError", err)
+			case tt.kind >= 0 && apiErr.Kind != tt.kind:
+				t.Errorf("APIError kind = %d, want %d", apiErr.Kind, tt.kind)
+			}
+			if requests != 1 {
+				t.Errorf("sent %d requests, want 1", requests)
+			}
+		})
+	}
+}
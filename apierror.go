@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxRequestRetries is how many times an LLM request that failed with a
+// temporary error is sent again
+const MaxRequestRetries = 3
+
+// Backoff between retries, unless the provider sends Retry-After
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 20 * time.Second
+	// maxRetryAfter is the longest Retry-After uc waits for before giving up
+	maxRetryAfter = time.Minute
+)
+
+// maxErrorBody limits how much of a failed response is read
+const maxErrorBody = 64 * 1024
+
+// APIErrorKind classifies failed LLM requests
+type APIErrorKind int
+
+const (
+	APIErrorOther APIErrorKind = iota
+	APIErrorAuth
+	APIErrorRateLimit
+	APIErrorQuota
+	APIErrorServer
+	APIErrorBlocked
+)
+
+// describe returns what went wrong for each kind of error
+func (k APIErrorKind) describe() string {
+	switch k {
+	case APIErrorAuth:
+		return "rejected the API key"
+	case APIErrorRateLimit:
+		return "rate limit exceeded"
+	case APIErrorQuota:
+		return "quota exceeded"
+	case APIErrorServer:
+		return "server error"
+	case APIErrorBlocked:
+		return "blocked the response"
+	default:
+		return "API error"
+	}
+}
+
+// APIError is a request an LLM provider answered with an error
+type APIError struct {
+	Provider string
+	Kind     APIErrorKind
+	// StatusCode is the HTTP status, or 0 for errors reported in an
+	// otherwise successful response
+	StatusCode int
+	// Code is the provider's own error type or code, if any
+	Code    string
+	Message string
+	// RetryAfter is how long the provider asked to wait before retrying
+	RetryAfter time.Duration
+	// Retries is how many times the request was retried before giving up
+	Retries int
+}
+
+// Error formats the error with the provider's message
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", e.Provider, e.Kind.describe())
+	switch {
+	case e.StatusCode != 0 && e.Code != "":
+		fmt.Fprintf(&b, " (%d %s)", e.StatusCode, e.Code)
+	case e.StatusCode != 0:
+		fmt.Fprintf(&b, " (%d)", e.StatusCode)
+	case e.Code != "":
+		fmt.Fprintf(&b, " (%s)", e.Code)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	if e.Retries > 0 {
+		fmt.Fprintf(&b, " (gave up after %d retries)", e.Retries)
+	}
+	return b.String()
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *APIError) Retryable() bool {
+	return e.Kind == APIErrorRateLimit || e.Kind == APIErrorServer
+}
+
+// apiErrorBody covers the error bodies of the supported providers: OpenAI
+// and Anthropic send {"error": {"type", "message"}}, OpenAI adds a code,
+// Gemini sends {"error": {"code", "message", "status"}}, and Ollama sends
+// {"error": "message"}
+type apiErrorBody struct {
+	Error json.RawMessage `json:"error"`
+}
+
+// apiErrorDetail is the object form of apiErrorBody.Error
+type apiErrorDetail struct {
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+	Status  string          `json:"status"`
+}
+
+// newAPIError describes a response with a status other than 200 OK
+func newAPIError(provider string, resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	var parsed apiErrorBody
+	var detail apiErrorDetail
+	switch {
+	case json.Unmarshal(body, &parsed) != nil || len(parsed.Error) == 0:
+		apiErr.Message = strings.TrimSpace(string(body))
+	case json.Unmarshal(parsed.Error, &apiErr.Message) == nil:
+	case json.Unmarshal(parsed.Error, &detail) == nil:
+		apiErr.Message = detail.Message
+		apiErr.Code = detail.Status
+		if apiErr.Code == "" {
+			apiErr.Code = detail.Type
+		}
+		if code := strings.Trim(string(detail.Code), `"`); apiErr.Code == "" && code != "null" {
+			apiErr.Code = code
+		}
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+
+	switch status := resp.StatusCode; {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		apiErr.Kind = APIErrorAuth
+	case status == http.StatusPaymentRequired:
+		apiErr.Kind = APIErrorQuota
+	case status == http.StatusTooManyRequests:
+		apiErr.Kind = APIErrorRateLimit
+		// Running out of credit is reported as 429 too but won't clear up
+		if strings.Contains(string(body), "insufficient_quota") || strings.Contains(strings.ToLower(apiErr.Message), "billing") {
+			apiErr.Kind = APIErrorQuota
+		}
+	case status == http.StatusRequestTimeout || status >= 500:
+		apiErr.Kind = APIErrorServer
+	}
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		return max(time.Until(when), 0)
+	}
+	return 0
+}
+
+// retryDelay returns how long to wait before retry number attempt+1: the
+// provider's Retry-After if given, otherwise an exponential backoff with
+// jitter so that several clients don't retry in lockstep
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	delay := min(retryBaseDelay<<attempt, retryMaxDelay)
+	return delay/2 + rand.N(delay/2)
+}
+
+// isTemporaryNetError reports whether a request that failed without a
+// response may succeed if sent again: the connection was reset or closed
+// before the response arrived, or connecting timed out. Hitting the request
+// timeout is not retried, as it covers the whole request and a provider that
+// is slow to answer would only be waited for again.
+func isTemporaryNetError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return opErr.Timeout()
+	}
+	// The request timeout is reported as a deadline being exceeded, unlike a
+	// TLS handshake timeout
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// sendRequest sends the request built by newRequest and returns the response
+// if it succeeded. Other responses are returned as an *APIError, after
+// retrying with backoff if the failure looks temporary. Requests that can't
+// connect in time or lose their connection are retried the same way.
+// newRequest is called again for every attempt.
+func sendRequest(ctx context.Context, client *http.Client, provider string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		var delay time.Duration
+		resp, err := client.Do(req)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("failed to call %s API: %w", provider, err)
+			// A cancelled request fails with a network error too
+			if ctx.Err() != nil || !isTemporaryNetError(err) {
+				return nil, err
+			}
+			if attempt >= MaxRequestRetries {
+				return nil, fmt.Errorf("%w (gave up after %d retries)", err, attempt)
+			}
+			delay = retryDelay(attempt, 0)
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		default:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+			apiErr := newAPIError(provider, resp, body)
+			apiErr.Retries = attempt
+			if !apiErr.Retryable() || attempt >= MaxRequestRetries || apiErr.RetryAfter > maxRetryAfter {
+				return nil, apiErr
+			}
+			delay = retryDelay(attempt, apiErr.RetryAfter)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error that timed out, such as a TLS handshake
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadlineError is a timeout caused by a deadline, as the request timeout
+// and dial timeouts are reported
+type deadlineError struct{ timeoutError }
+
+func (deadlineError) Is(err error) bool { return err == context.DeadlineExceeded }
+
+func TestIsTemporaryNetError(t *testing.T) {
+	wrap := func(err error) error {
+		return fmt.Errorf("failed to call Test API: %w", &url.Error{Op: "Post", URL: "https://example.com", Err: err})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection reset", wrap(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), true},
+		{"connection closed early", wrap(io.EOF), true},
+		{"connect timeout", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: deadlineError{}}), true},
+		{"TLS handshake timeout", wrap(timeoutError{}), true},
+		{"request timeout", wrap(deadlineError{}), false},
+		{"connection refused", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), false},
+		{"unknown host", wrap(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}), false},
+		{"bad certificate", wrap(x509.UnknownAuthorityError{}), false},
+		{"cancelled", wrap(context.Canceled), false},
+	}
+	for _, tt := range tests {
+		if got := isTemporaryNetError(tt.err); got != tt.want {
+			t.Errorf("isTemporaryNetError(%s) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		want       APIError
+	}{
+		{
+			name:   "OpenAI invalid key",
+			status: 401,
+			body:   `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`,
+			want:   APIError{Kind: APIErrorAuth, Code: "invalid_request_error", Message: "Incorrect API key provided"},
+		},
+		{
+			name:   "OpenAI code without a type",
+			status: 404,
+			body:   `{"error":{"message":"The model does not exist","type":null,"code":"model_not_found"}}`,
+			want:   APIError{Kind: APIErrorOther, Code: "model_not_found", Message: "The model does not exist"},
+		},
+		{
+			name:   "OpenAI null code",
+			status: 400,
+			body:   `{"error":{"message":"Invalid value","code":null}}`,
+			want:   APIError{Kind: APIErrorOther, Message: "Invalid value"},
+		},
+		{
+			name:       "rate limit",
+			status:     429,
+			retryAfter: "7",
+			body:       `{"error":{"message":"Rate limit reached","type":"requests"}}`,
+			want:       APIError{Kind: APIErrorRateLimit, Code: "requests", Message: "Rate limit reached", RetryAfter: 7 * time.Second},
+		},
+		{
+			name:   "insufficient quota reported as 429",
+			status: 429,
+			body:   `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`,
+			want:   APIError{Kind: APIErrorQuota, Code: "insufficient_quota", Message: "You exceeded your current quota"},
+		},
+		{
+			name:   "billing problem reported as 429",
+			status: 429,
+			body:   `{"error":{"message":"Please check your Billing details"}}`,
+			want:   APIError{Kind: APIErrorQuota, Message: "Please check your Billing details"},
+		},
+		{
+			name:   "payment required",
+			status: 402,
+			want:   APIError{Kind: APIErrorQuota, Message: "Payment Required"},
+		},
+		{
+			name:   "Gemini overloaded",
+			status: 503,
+			body:   `{"error":{"code":503,"message":"The model is overloaded.","status":"UNAVAILABLE"}}`,
+			want:   APIError{Kind: APIErrorServer, Code: "UNAVAILABLE", Message: "The model is overloaded."},
+		},
+		{
+			name:   "Gemini invalid key",
+			status: 400,
+			body:   `{"error":{"code":400,"message":"API key not valid.","status":"INVALID_ARGUMENT"}}`,
+			want:   APIError{Kind: APIErrorOther, Code: "INVALID_ARGUMENT", Message: "API key not valid."},
+		},
+		{
+			name:   "Ollama string error",
+			status: 404,
+			body:   `{"error":"model \"llama9\" not found, try pulling it first"}`,
+			want:   APIError{Kind: APIErrorOther, Message: `model "llama9" not found, try pulling it first`},
+		},
+		{
+			name:   "proxy error page",
+			status: 502,
+			body:   "upstream connect error\n",
+			want:   APIError{Kind: APIErrorServer, Message: "upstream connect error"},
+		},
+		{
+			name:   "request timeout",
+			status: 408,
+			want:   APIError{Kind: APIErrorServer, Message: "Request Timeout"},
+		},
+		{
+			name:   "forbidden",
+			status: 403,
+			body:   `{"error":{"type":"permission_error","message":"not allowed"}}`,
+			want:   APIError{Kind: APIErrorAuth, Code: "permission_error", Message: "not allowed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			want := tt.want
+			want.Provider, want.StatusCode = "Test", tt.status
+			if got := newAPIError("Test", resp, []byte(tt.body)); *got != want {
+				t.Errorf("newAPIError = %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	future := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got <= 20*time.Second || got > 30*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 30s", future, got)
+	}
+}
+
+// countingServer starts a server that answers with handler and counts the
+// requests it receives
+func countingServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, n int32)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, requests.Add(1))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// postTo returns a newRequest function for sendRequest
+func postTo(url string) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		return http.NewRequest("POST", url, nil)
+	}
+}
+
+func TestSendRequestRetriesServerErrors(t *testing.T) {
+	server, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	resp, err := sendRequest(context.Background(), server.Client(), "Test", postTo(server.URL))
+	if err != nil {
+		t.Fatalf("sendRequest failed: %v", err)
+	}
+	resp.Body.Close()
+	if n := requests.Load(); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestSendRequestGivesUpOnLongRetryAfter(t *testing.T) {
+	server, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Header().Set("Retry-After", fmt.Sprint(int((maxRetryAfter + time.Minute).Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := sendRequest(context.Background(), server.Client(), "Test", postTo(server.URL))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != APIErrorRateLimit || apiErr.Retries != 0 {
+		t.Errorf("sendRequest error = %v, want a rate limit error without retries", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestSendRequestDoesNotRetryRequestTimeout(t *testing.T) {
+	server, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		<-r.Context().Done()
+	})
+	client := server.Client()
+	client.Timeout = 100 * time.Millisecond
+
+	_, err := sendRequest(context.Background(), client, "Test", postTo(server.URL))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sendRequest error = %v, want a timeout", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestSendRequestRetriesDroppedConnections(t *testing.T) {
+	server, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			// Drop the connection without answering
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatalf("could not hijack connection: %v", err)
+			}
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	client := server.Client()
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+	resp, err := sendRequest(context.Background(), client, "Test", postTo(server.URL))
+	if err != nil {
+		t.Fatalf("sendRequest failed: %v", err)
+	}
+	resp.Body.Close()
+	if n := requests.Load(); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestSendRequestKeepsCause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := sendRequest(ctx, http.DefaultClient, "Test", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "POST", "http://127.0.0.1:1", nil)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("sendRequest error = %v, want one wrapping context.Canceled", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readRequests reads one natural language request per line, skipping blank
+// lines and lines starting with #
+func readRequests(r io.Reader) ([]string, error) {
+	var requests []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		requests = append(requests, line)
+	}
+	return requests, scanner.Err()
+}
+
+// loadRequests reads requests from file, or from stdin if file is "-"
+func loadRequests(file string) ([]string, error) {
+	if file == "-" {
+		return readRequests(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRequests(f)
+}
+
+// runBatch processes requests in order in a single session, so later requests
+// see the working directory and environment left by earlier ones. It prints a
+// summary at the end and returns the exit code of the first request that did
+// not succeed, or ExitOK.
+func runBatch(llmClient LLMClient, requests []string, opts *RunOptions, stopOnError bool) int {
+	state := NewSessionState()
+	defer state.Close()
+	if opts.Review {
+		rl, err := newReviewReadline(opts)
+		if err != nil {
+			printError("Error initializing readline: %v", err)
+			return ExitSystemError
+		}
+		defer rl.Close()
+	}
+
+	results := make([]*CommandResult, 0, len(requests))
+	for i, request := range requests {
+		if i > 0 {
+			fmt.Println()
+		}
+		colorHeader.Printf("[%d/%d] ", i+1, len(requests))
+		fmt.Println(request)
+
+		result := processCommand(llmClient, state, request, opts)
+		results = append(results, result)
+
+		if result.ExitCode() == ExitOK {
+			continue
+		}
+		// Ctrl-C while a command is generated or running stops the runbook
+		var cmdErr *CommandError
+		if errors.Is(result.Err, errGenerationCancelled) || (errors.As(result.Err, &cmdErr) && cmdErr.Interrupted) {
+			colorWarning.Println("Interrupted; skipping the remaining requests.")
+			break
+		}
+		if stopOnError {
+			colorWarning.Println("Stopping after the first failed request.")
+			break
+		}
+	}
+
+	showBatchSummary(requests, results)
+
+	for _, result := range results {
+		if code := result.ExitCode(); code != ExitOK {
+			return code
+		}
+	}
+	return ExitOK
+}
+
+// showBatchSummary prints the outcome of each request; requests after
+// len(results) were skipped
+func showBatchSummary(requests []string, results []*CommandResult) {
+	counts := make(map[CommandStatus]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	fmt.Println()
+	colorHeader.Println("Summary")
+	for i, request := range requests {
+		fmt.Printf("  %d. ", i+1)
+		if i >= len(results) {
+			colorWarning.Print("skipped")
+			fmt.Printf("  %s\n", request)
+			continue
+		}
+
+		result := results[i]
+		switch result.Status {
+		case StatusSucceeded, StatusDryRun:
+			colorSuccess.Print(statusLabel(result.Status))
+		case StatusFailed:
+			colorError.Printf("%s (%v)", statusLabel(result.Status), result.Err)
+		default:
+			colorWarning.Print(statusLabel(result.Status))
+		}
+		fmt.Printf("  %s\n", request)
+		if result.Command != "" {
+			fmt.Print("     ")
+			colorCommand.Println(result.Command)
+		}
+	}
+
+	parts := []string{fmt.Sprintf("%d requests", len(requests))}
+	for _, status := range []CommandStatus{StatusSucceeded, StatusDryRun, StatusFailed, StatusGenerationFailed, StatusRefused, StatusCancelled} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], statusLabel(status)))
+		}
+	}
+	if skipped := len(requests) - len(results); skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", skipped))
+	}
+	fmt.Println(strings.Join(parts, ", "))
+}
+
+// statusLabel returns a human-readable name for status
+func statusLabel(status CommandStatus) string {
+	return strings.ReplaceAll(status.String(), "_", " ")
+}
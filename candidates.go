@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// MaxCandidates limits how many alternative commands are asked for
+const MaxCandidates = 5
+
+// CandidateLLMClient is an LLMClient that can ask for several alternative
+// commands in a single request
+type CandidateLLMClient interface {
+	LLMClient
+	GenerateCandidates(ctx context.Context, request *CommandRequest, n int) ([]*CommandResponse, error)
+}
+
+// generateCandidates asks for n alternative commands, in one request if the
+// client supports it and by sampling the request repeatedly otherwise
+func generateCandidates(ctx context.Context, client LLMClient, request *CommandRequest, n int) ([]*CommandResponse, error) {
+	if multi, ok := client.(CandidateLLMClient); ok {
+		return multi.GenerateCandidates(ctx, request, n)
+	}
+
+	var responses []*CommandResponse
+	for i := 0; i < n; i++ {
+		response, err := client.GenerateCommand(ctx, request)
+		if err != nil {
+			// Settle for the candidates generated so far, if any
+			if len(responses) > 0 && ctx.Err() == nil {
+				break
+			}
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// Candidate is one of several generated commands, with what was found when
+// checking it locally
+type Candidate struct {
+	Response *CommandResponse
+	Risk     RiskAssessment
+	// Missing lists the programs used that are not installed
+	Missing []string
+	// Unportable lists GNU- or BSD-specific usages that this OS's versions
+	// of the tools don't support
+	Unportable []string
+}
+
+// rankCandidates drops duplicate and empty commands and orders the rest so
+// that commands likely to run as they are come first: those without missing
+// programs or unportable flags, then those with the lowest risk. Otherwise
+// the model's order is kept.
+func rankCandidates(responses []*CommandResponse, workingDir string) []*Candidate {
+	var candidates []*Candidate
+	seen := make(map[string]bool)
+	for _, response := range responses {
+		key := strings.Join(strings.Fields(response.Command), " ")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		risk := AnalyzeRisk(response.Command, workingDir)
+		if level := response.RiskLevel(); level > risk.Level {
+			risk.raise(level, "model assessed risk as "+level.String())
+		}
+		candidates = append(candidates, &Candidate{
+			Response:   response,
+			Risk:       risk,
+			Missing:    missingPrograms(response),
+			Unportable: unportableUsages(response.Command, runtime.GOOS),
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if problems, other := len(a.Missing)+len(a.Unportable), len(b.Missing)+len(b.Unportable); problems != other {
+			return problems < other
+		}
+		return a.Risk.Level < b.Risk.Level
+	})
+	return candidates
+}
+
+// missingPrograms returns the programs a command runs, or that the model
+// says it uses, that are not on PATH
+func missingPrograms(response *CommandResponse) []string {
+	missing := response.MissingTools()
+	for _, args := range commandArgs(response.Command) {
+		name := args[0]
+		// Scripts given by path and shell syntax can't be looked up
+		if strings.ContainsAny(name, "/$`=") || isShellBuiltin(name) {
+			continue
+		}
+		if _, err := exec.LookPath(name); err != nil && !containsString(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// commandArgs returns the arguments of each simple command in command and
+// its substitutions, without prefixes such as sudo or env
+func commandArgs(command string) [][]string {
+	var result [][]string
+	for _, cmd := range parseCommandLine(command) {
+		if args := stripCommandPrefixes(cmd.args, &RiskAssessment{}); len(args) > 0 {
+			result = append(result, args)
+		}
+	}
+	return result
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// portabilityRule is a usage of a program that only the GNU or only the BSD
+// version of it supports
+type portabilityRule struct {
+	program string
+	usage   string
+	gnuOnly bool
+	// matches is given the program's arguments and the flags among them
+	matches func(args []string, flags []string) bool
+}
+
+// portabilityRules cover common flags that differ between the GNU tools on
+// Linux and the BSD tools on macOS and the BSDs. Flags with attached values,
+// such as date -v-1d, are compared whole rather than with hasFlag, which
+// would take the value's letters for flags.
+var portabilityRules = []portabilityRule{
+	{"find", "find -printf", true, func(args, flags []string) bool {
+		return containsString(flags, "-printf") || containsString(flags, "-fprintf")
+	}},
+	{"stat", "stat -c", true, func(args, flags []string) bool {
+		return containsString(flags, "-c") || hasFlag(flags, "format", "printf")
+	}},
+	{"stat", "stat -f", false, func(args, flags []string) bool {
+		return argAfter(args, "-f", func(v string) bool { return strings.Contains(v, "%") })
+	}},
+	{"date", "date -d", true, func(args, flags []string) bool {
+		return containsString(flags, "-d") || hasFlag(flags, "date")
+	}},
+	{"date", "date -v", false, func(args, flags []string) bool { return hasArgPrefix(flags, "-v") }},
+	{"grep", "grep -P", true, func(args, flags []string) bool { return hasFlag(flags, "P", "perl-regexp") }},
+	{"du", "du --max-depth", true, func(args, flags []string) bool { return hasFlag(flags, "max-depth") }},
+	{"xargs", "xargs --no-run-if-empty", true, func(args, flags []string) bool { return hasFlag(flags, "no-run-if-empty") }},
+	{"sed", "sed -i without a suffix", true, func(args, flags []string) bool {
+		return argAfter(args, "-i", func(v string) bool { return v != "" })
+	}},
+	{"sed", "sed -i ''", false, func(args, flags []string) bool {
+		return argAfter(args, "-i", func(v string) bool { return v == "" })
+	}},
+}
+
+// unportableUsages returns the usages in command that need the GNU tools
+// when goos has BSD ones, or the other way around
+func unportableUsages(command string, goos string) []string {
+	var gnu bool
+	switch goos {
+	case "linux":
+		gnu = true
+	case "darwin", "freebsd", "openbsd", "netbsd", "dragonfly":
+		gnu = false
+	default:
+		return nil
+	}
+
+	var found []string
+	for _, args := range commandArgs(command) {
+		_, flags := splitFlags(args[1:])
+		for _, rule := range portabilityRules {
+			if rule.gnuOnly != gnu && args[0] == rule.program && rule.matches(args[1:], flags) {
+				flavor := "BSD"
+				if rule.gnuOnly {
+					flavor = "GNU"
+				}
+				found = append(found, fmt.Sprintf("%s needs %s %s", rule.usage, flavor, rule.program))
+			}
+		}
+	}
+	return found
+}
+
+// hasArgPrefix reports whether an argument starts with prefix
+func hasArgPrefix(args []string, prefix string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// argAfter reports whether flag is followed by an argument matching match
+func argAfter(args []string, flag string, match func(string) bool) bool {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) && match(args[i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// showCandidates prints a numbered menu of candidates with their
+// explanations and any problems found
+func showCandidates(candidates []*Candidate) {
+	colorHeader.Printf("%d candidate commands:\n", len(candidates))
+	for i, c := range candidates {
+		colorInfo.Printf("%2d) ", i+1)
+		colorCommand.Println(c.Response.Command)
+		if c.Response.Explanation != "" {
+			fmt.Printf("    %s\n", c.Response.Explanation)
+		}
+		if len(c.Missing) > 0 {
+			colorWarning.Fprintf(os.Stderr, "    Not found on PATH: %s\n", strings.Join(c.Missing, ", "))
+		}
+		for _, usage := range c.Unportable {
+			colorWarning.Fprintf(os.Stderr, "    Not portable: %s\n", usage)
+		}
+		showRiskIndented(c.Risk, "    ")
+	}
+}
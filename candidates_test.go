@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestUnportableUsages(t *testing.T) {
+	tests := []struct {
+		command string
+		goos    string
+		want    []string
+	}{
+		{"find . -name '*.go' -printf '%s %p\\n'", "darwin", []string{"find -printf needs GNU find"}},
+		{"find . -name '*.go' -printf '%s %p\\n'", "linux", nil},
+		{"stat -c %s file", "darwin", []string{"stat -c needs GNU stat"}},
+		{"stat --format=%s file", "freebsd", []string{"stat -c needs GNU stat"}},
+		{"stat -f %z file", "linux", []string{"stat -f needs BSD stat"}},
+		{"stat -f '%Sm %N' file", "linux", []string{"stat -f needs BSD stat"}},
+		{"stat -f /", "linux", nil},
+		{"stat -f %z file", "darwin", nil},
+		{"date -d yesterday +%F", "darwin", []string{"date -d needs GNU date"}},
+		{"date --date='1 day ago'", "openbsd", []string{"date -d needs GNU date"}},
+		{"date -v-1d +%F", "linux", []string{"date -v needs BSD date"}},
+		{"date -v-1d +%F", "darwin", nil},
+		{"grep -oP '\\d+' log", "darwin", []string{"grep -P needs GNU grep"}},
+		{"grep --perl-regexp x", "netbsd", []string{"grep -P needs GNU grep"}},
+		{"grep -r pattern .", "darwin", nil},
+		{"du -h --max-depth=1", "darwin", []string{"du --max-depth needs GNU du"}},
+		{"find . | xargs --no-run-if-empty rm", "darwin", []string{"xargs --no-run-if-empty needs GNU xargs"}},
+		{"sed -i 's/a/b/' file", "darwin", []string{"sed -i without a suffix needs GNU sed"}},
+		{"sed -i 's/a/b/' file", "linux", nil},
+		{"sed -i '' 's/a/b/' file", "linux", []string{"sed -i '' needs BSD sed"}},
+		{"sed -i '' 's/a/b/' file", "darwin", nil},
+		{"sed -i.bak 's/a/b/' file", "linux", nil},
+		{"sed -i.bak 's/a/b/' file", "darwin", nil},
+		{"sudo sed -i 's/a/b/' /etc/hosts && date -d now", "darwin", []string{"sed -i without a suffix needs GNU sed", "date -d needs GNU date"}},
+		{"echo $(stat -c %s file)", "darwin", []string{"stat -c needs GNU stat"}},
+		{"stat -c %s file", "windows", nil},
+	}
+	for _, tt := range tests {
+		if got := unportableUsages(tt.command, tt.goos); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("unportableUsages(%q, %s) = %q, want %q", tt.command, tt.goos, got, tt.want)
+		}
+	}
+}
+
+func TestPortabilityRules(t *testing.T) {
+	for _, rule := range portabilityRules {
+		if rule.program == "" || rule.usage == "" || rule.matches == nil {
+			t.Errorf("incomplete portability rule %+v", rule)
+		}
+		if rule.matches(nil, nil) {
+			t.Errorf("rule %q matches a command without arguments", rule.usage)
+		}
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	unportable := "stat -f %z file"
+	if runtime.GOOS != "linux" {
+		unportable = "stat -c %s file"
+	}
+	responses := []*CommandResponse{
+		{Command: "rm -r build"},
+		{Command: "uc-test-missing-program --all"},
+		{Command: unportable},
+		{Command: "ls -la"},
+		{Command: "  ls   -la "},
+		{Command: " "},
+		{Command: "ls -l", Risk: "high"},
+		{Command: "ls -a", Tools: []string{"uc-test-missing-tool"}},
+		{Command: "pwd"},
+	}
+	candidates := rankCandidates(responses, t.TempDir())
+
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.Response.Command)
+	}
+	want := []string{"ls -la", "pwd", "rm -r build", "ls -l", "uc-test-missing-program --all", unportable, "ls -a"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("rankCandidates order = %q, want %q", got, want)
+	}
+
+	byCommand := make(map[string]*Candidate)
+	for _, c := range candidates {
+		byCommand[c.Response.Command] = c
+	}
+	if c := byCommand["ls -l"]; c.Risk.Level != RiskHigh {
+		t.Errorf("risk of %q = %s, want the model's high assessment", c.Response.Command, c.Risk.Level)
+	}
+	if c := byCommand["uc-test-missing-program --all"]; fmt.Sprint(c.Missing) != "[uc-test-missing-program]" {
+		t.Errorf("missing programs = %q", c.Missing)
+	}
+	if c := byCommand["ls -a"]; fmt.Sprint(c.Missing) != "[uc-test-missing-tool]" {
+		t.Errorf("missing tools = %q", c.Missing)
+	}
+	if c := byCommand[unportable]; len(c.Unportable) != 1 {
+		t.Errorf("unportable usages of %q = %q, want one", unportable, c.Unportable)
+	}
+}
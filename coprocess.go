@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// persistentShellWaitDelay bounds how long uc waits for a finished shell's
+// output to drain when background jobs still hold it open
+const persistentShellWaitDelay = time.Second
+
+// persistentShell is a long-lived shell coprocess that runs every command of
+// a session. Scripts are written to the shell's stdin; the command itself
+// reads the user's stdin through fd 4 and writes errors to fd 5, where their
+// tail is kept, and completion is reported with a unique marker on fd 3 so
+// it never mixes with command output. The marker is also written to fd 5,
+// and filtered out of it, to tell when all of the command's errors have been
+// copied. The shell's own stderr, which interactive commands also use, is
+// the user's.
+type persistentShell struct {
+	kind      string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	control   *bufio.Reader
+	controlR  *os.File
+	stderrR   *os.File
+	done      chan struct{}
+	stateDir  string
+	envFile   string
+	shellFile string
+	capture   string
+	stderr    *syncTailBuffer
+	marker    string
+	seq       int
+	// stderrSeq is the last command whose marker was seen on fd 5, and
+	// stderrMarked is signalled each time it changes
+	stderrSeq    atomic.Int64
+	stderrMarked chan struct{}
+	// foreground is set when the shell's process group is given the
+	// terminal while a command runs. The shell then runs with job control,
+	// so each command gets a process group of its own that the shell hands
+	// the terminal to, and Ctrl-C or a timeout stops only that group.
+	foreground bool
+}
+
+// exitStatusError reports a command's non-zero exit status from the
+// persistent shell
+type exitStatusError int
+
+// Error implements the error interface
+func (e exitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// startPersistentShell starts a shell coprocess and replays the session's
+// environment, working directory and shell-local state into it
+func startPersistentShell(state *SessionState) (*persistentShell, error) {
+	shell := userShell()
+	kind := shellKind(shell)
+
+	stateDir, err := os.MkdirTemp("", "uc-shell-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+	sh := &persistentShell{
+		kind:         kind,
+		done:         make(chan struct{}),
+		stateDir:     stateDir,
+		envFile:      filepath.Join(stateDir, "env"),
+		shellFile:    filepath.Join(stateDir, "shell"),
+		stderr:       &syncTailBuffer{tailBuffer: tailBuffer{max: MaxCapturedStderr}},
+		stderrMarked: make(chan struct{}, 1),
+		foreground:   isTerminal(os.Stdin),
+	}
+	if sh.capture, err = captureScript(kind, sh.envFile, sh.shellFile); err != nil {
+		os.RemoveAll(stateDir)
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	sh.marker = "__UC_DONE_" + hex.EncodeToString(nonce)
+
+	controlR, controlW, err := os.Pipe()
+	if err != nil {
+		os.RemoveAll(stateDir)
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		controlR.Close()
+		controlW.Close()
+		os.RemoveAll(stateDir)
+		return nil, err
+	}
+	cleanup := func() {
+		controlR.Close()
+		controlW.Close()
+		stderrR.Close()
+		stderrW.Close()
+		os.RemoveAll(stateDir)
+	}
+
+	// Job control must be requested on the command line for bash to find
+	// the terminal on its stderr, and shells only hand the terminal to their
+	// jobs if they start out in the foreground. The shell keeps the terminal
+	// until run gives it back to uc after the first command.
+	sh.cmd = exec.Command(shell, "-s")
+	if sh.foreground {
+		sh.cmd.Args = []string{shell, "-m", "-s"}
+	}
+	sh.cmd.Dir = state.WorkingDir
+	sh.cmd.Env = state.Environ()
+	sh.cmd.Stdout = os.Stdout
+	sh.cmd.Stderr = os.Stderr
+	sh.cmd.ExtraFiles = []*os.File{controlW, os.Stdin, stderrW}
+	sh.cmd.WaitDelay = persistentShellWaitDelay
+	setProcessGroup(sh.cmd, sh.foreground)
+	if sh.stdin, err = sh.cmd.StdinPipe(); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := sh.cmd.Start(); err != nil {
+		restoreForeground()
+		cleanup()
+		return nil, err
+	}
+	controlW.Close()
+	stderrW.Close()
+	sh.controlR = controlR
+	sh.control = bufio.NewReader(controlR)
+	sh.stderrR = stderrR
+	go func() {
+		filter := &markerFilter{w: io.MultiWriter(os.Stderr, sh.stderr), marker: sh.marker + "_", found: sh.markStderr}
+		io.Copy(filter, stderrR)
+		filter.flush()
+	}()
+
+	go func() {
+		sh.cmd.Wait()
+		close(sh.done)
+	}()
+
+	// Replay shell-local state and capture state if the shell exits
+	trap, _ := captureTrap(kind, sh.envFile, sh.shellFile)
+	init := state.restoreScript(kind) + trap + "\n"
+	if sh.foreground {
+		// The INT trap keeps shells such as dash from interrupting
+		// themselves when a job is stopped with Ctrl-C; commands still get
+		// the default handler
+		init += "trap : INT\n"
+	}
+	if _, err := io.WriteString(sh.stdin, init); err != nil {
+		restoreForeground()
+		sh.close()
+		return nil, fmt.Errorf("could not initialize shell: %v", err)
+	}
+	return sh, nil
+}
+
+// run sends a command to the shell and waits for its completion marker. It
+// returns the tail of stderr and whether the shell is still alive. An
+// interactive command gets the user's terminal as its stderr, so none of it
+// is kept. If ctx is cancelled the command's process group is stopped,
+// leaving the shell and its background jobs running.
+func (sh *persistentShell) run(ctx context.Context, state *SessionState, command string, interactive bool) (stderr string, alive bool, err error) {
+	sh.seq++
+	marker := fmt.Sprintf("%s_%d", sh.marker, sh.seq)
+	sh.stderr.Reset()
+
+	// eval keeps a syntax error from leaving the shell waiting for input;
+	// closing fd 3 for the command keeps background jobs from holding it
+	redirects := "<&4 2>&5 3>&-"
+	if interactive {
+		redirects = "<&4 3>&-"
+	}
+	script := fmt.Sprintf("{ eval %s; } %s\n__uc_status=$?\n%s\n{ printf '%%s\\n' %s >&5; } 2>/dev/null\nprintf '%%s %%s\\n' %s \"$__uc_status\" >&3\n",
+		shellescape(command), redirects, sh.capture, marker, marker)
+	if _, err := io.WriteString(sh.stdin, script); err != nil {
+		return "", false, err
+	}
+
+	pid := sh.cmd.Process.Pid
+	if sh.foreground {
+		setForeground(pid)
+		defer restoreForeground()
+	}
+	killTimer := make(chan *time.Timer, 1)
+	stopWatching := context.AfterFunc(ctx, func() {
+		killTimer <- stopProcessGroup(ctx, sh.commandGroup())
+	})
+	defer func() {
+		// A shell that survived the signal is kept for the next command
+		if !stopWatching() && alive {
+			(<-killTimer).Stop()
+		}
+	}()
+
+	for {
+		line, readErr := sh.control.ReadString('\n')
+		if readErr != nil {
+			// The shell exited, for example because the command called exit
+			<-sh.done
+			state.loadState(sh.envFile)
+			state.loadShellState(sh.shellFile, sh.kind)
+			if sh.cmd.ProcessState.Success() {
+				return sh.stderr.String(), false, nil
+			}
+			return sh.stderr.String(), false, &exec.ExitError{ProcessState: sh.cmd.ProcessState}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != marker {
+			continue
+		}
+		sh.waitStderr(sh.seq)
+		state.loadState(sh.envFile)
+		state.loadShellState(sh.shellFile, sh.kind)
+		if code, _ := strconv.Atoi(fields[1]); code != 0 {
+			return sh.stderr.String(), true, exitStatusError(code)
+		}
+		return sh.stderr.String(), true, nil
+	}
+}
+
+// markStderr records that the marker of command seq was seen on fd 5
+func (sh *persistentShell) markStderr(seq int) {
+	sh.stderrSeq.Store(int64(seq))
+	select {
+	case sh.stderrMarked <- struct{}{}:
+	default:
+	}
+}
+
+// waitStderr waits until the errors of command seq have been copied from fd
+// 5. A command that closed fd 5 keeps its marker from being written, so the
+// wait is bounded.
+func (sh *persistentShell) waitStderr(seq int) {
+	timeout := time.NewTimer(persistentShellWaitDelay)
+	defer timeout.Stop()
+	for sh.stderrSeq.Load() < int64(seq) {
+		select {
+		case <-sh.stderrMarked:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// commandGroup returns the process group of the command the shell is
+// running. With job control that is the terminal's foreground group; when
+// there is none, or the shell itself is busy running a builtin, the shell's
+// own group is returned, and stopping it ends the shell.
+func (sh *persistentShell) commandGroup() int {
+	pid := sh.cmd.Process.Pid
+	if sh.foreground {
+		if pgid := foregroundGroup(); pgid > 0 && pgid != pid && pgid != ownGroup() {
+			return pgid
+		}
+	}
+	return pid
+}
+
+// close stops the shell and removes its state files
+func (sh *persistentShell) close() {
+	sh.stdin.Close()
+	select {
+	case <-sh.done:
+	case <-time.After(persistentShellWaitDelay):
+		sh.cmd.Process.Kill()
+		<-sh.done
+	}
+	sh.controlR.Close()
+	sh.stderrR.Close()
+	os.RemoveAll(sh.stateDir)
+}
+
+// runPersistent runs a command in the session's persistent shell, starting
+// or restarting the shell as needed. Interactive commands use the user's
+// terminal directly rather than a pseudo-terminal of their own.
+func (s *SessionState) runPersistent(ctx context.Context, command string, interactive bool) (stderr string, runErr error, err error) {
+	if s.shell == nil {
+		if s.shell, err = startPersistentShell(s); err != nil {
+			return "", nil, fmt.Errorf("could not start persistent shell: %v", err)
+		}
+	}
+
+	stderr, alive, runErr := s.shell.run(ctx, s, command, interactive)
+	if !alive {
+		// Restart on the next command, replaying the captured state
+		s.shell.close()
+		s.shell = nil
+		colorWarning.Fprintln(os.Stderr, "Shell exited; a new shell will be started for the next command.")
+	}
+	return stderr, runErr, nil
+}
+
+// Close stops the persistent shell, if one is running
+func (s *SessionState) Close() {
+	if s.shell != nil {
+		s.shell.close()
+		s.shell = nil
+	}
+}
+
+// markerFilter copies a stream to w without the marker lines in it, each a
+// marker followed by a command's sequence number, and calls found with the
+// number from each
+type markerFilter struct {
+	w       io.Writer
+	marker  string
+	found   func(seq int)
+	pending []byte
+}
+
+// Write implements io.Writer. Text that might be the start of a marker is
+// held back until the rest of it arrives.
+func (f *markerFilter) Write(p []byte) (int, error) {
+	f.pending = append(f.pending, p...)
+	for {
+		i := bytes.Index(f.pending, []byte(f.marker))
+		if i < 0 {
+			break
+		}
+		end := bytes.IndexByte(f.pending[i:], '\n')
+		if end < 0 {
+			f.w.Write(f.pending[:i])
+			f.pending = f.pending[i:]
+			return len(p), nil
+		}
+		f.w.Write(f.pending[:i])
+		if seq, err := strconv.Atoi(string(f.pending[i+len(f.marker) : i+end])); err == nil {
+			f.found(seq)
+		}
+		f.pending = f.pending[i+end+1:]
+	}
+
+	keep := 0
+	for n := min(len(f.pending), len(f.marker)-1); n > 0; n-- {
+		if bytes.HasSuffix(f.pending, []byte(f.marker[:n])) {
+			keep = n
+			break
+		}
+	}
+	f.w.Write(f.pending[:len(f.pending)-keep])
+	f.pending = f.pending[len(f.pending)-keep:]
+	return len(p), nil
+}
+
+// flush writes any text held back at the end of the stream
+func (f *markerFilter) flush() {
+	f.w.Write(f.pending)
+	f.pending = nil
+}
+
+// syncTailBuffer is a tailBuffer that is safe for concurrent use
+type syncTailBuffer struct {
+	mu sync.Mutex
+	tailBuffer
+}
+
+// Write implements io.Writer
+func (t *syncTailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tailBuffer.Write(p)
+}
+
+// String returns the retained bytes
+func (t *syncTailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tailBuffer.String()
+}
+
+// Reset discards the retained bytes
+func (t *syncTailBuffer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The persistent shell runs the test binary to capture its state
+	if len(os.Args) == 3 && os.Args[1] == stateDumpArg {
+		if err := dumpState(os.Args[2]); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMarkerFilter(t *testing.T) {
+	const marker = "__UC_DONE_abc_"
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+		seqs   []int
+	}{
+		{"no markers", "error: not found\n", "error: not found\n", nil},
+		{"marker after output", "error\n" + marker + "1\n", "error\n", []int{1}},
+		{"output without a newline", "50%" + marker + "2\n", "50%", []int{2}},
+		{"several markers", marker + "1\nlate\n" + marker + "2\n", "late\n", []int{1, 2}},
+		{"text like a marker", "__UC_\n__UC_DONE\n", "__UC_\n__UC_DONE\n", nil},
+		{"unfinished marker", "x" + marker + "3", "x" + marker + "3", nil},
+	}
+	for _, tt := range tests {
+		// Each stream is also written in pieces, split at every position
+		for split := 0; split <= len(tt.stream); split++ {
+			var out strings.Builder
+			var seqs []int
+			f := &markerFilter{w: &out, marker: marker, found: func(seq int) { seqs = append(seqs, seq) }}
+			f.Write([]byte(tt.stream[:split]))
+			f.Write([]byte(tt.stream[split:]))
+			f.flush()
+			if out.String() != tt.want || fmt.Sprint(seqs) != fmt.Sprint(tt.seqs) {
+				t.Errorf("%s split at %d: output %q, markers %v, want %q, %v", tt.name, split, out.String(), seqs, tt.want, tt.seqs)
+			}
+		}
+	}
+}
+
+func TestPersistentShellStderr(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	state := NewSessionState()
+	state.WorkingDir = t.TempDir()
+	defer state.Close()
+	for i := 0; i < 20; i++ {
+		command := fmt.Sprintf("i=0; while [ $i -lt 200 ]; do echo line$i >&2; i=$((i+1)); done; echo last%d >&2; exit 3", i)
+		got, runErr, err := state.runPersistent(context.Background(), "( "+command+" )", false)
+		if err != nil {
+			t.Fatalf("runPersistent failed: %v", err)
+		}
+		if runErr != exitStatusError(3) {
+			t.Errorf("command %d error = %v, want exit status 3", i, runErr)
+		}
+		if want := fmt.Sprintf("last%d\n", i); !strings.HasSuffix(got, want) || strings.Contains(got, "__UC_DONE") {
+			t.Fatalf("command %d stderr ends with %q, want %q", i, got[max(0, len(got)-40):], want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// MaxCapturedStderr limits how much stderr is kept for error reporting
+const MaxCapturedStderr = 8192
+
+// killGracePeriod is how long a cancelled command's process group has to exit
+// before it is killed
+const killGracePeriod = 2 * time.Second
+
+// Reasons a running command is cancelled
+var (
+	errCommandTimeout     = errors.New("command timed out")
+	errCommandInterrupted = errors.New("command interrupted")
+)
+
+// shellescape escapes a string for safe use in shell commands
+func shellescape(s string) string {
+	// Simple shell escaping - wrap in single quotes and escape any single quotes
+	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+}
+
+// ExecOptions controls how ExecuteCommandWithState runs a command
+type ExecOptions struct {
+	// ForcePTY runs every command on a pseudo-terminal instead of only the
+	// ones detected as interactive; in the persistent shell such commands
+	// use the user's terminal directly
+	ForcePTY bool
+	// Persistent runs commands in a long-lived shell kept for the session
+	Persistent bool
+	// Timeout stops a command that runs longer than this; 0 means no limit
+	Timeout time.Duration
+	// Stdout and Stderr, if set, receive the command's output instead of the
+	// terminal. Such commands always run in a shell of their own.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Input, if set, is fed to the command's stdin. Such commands always run
+	// in a shell of their own.
+	Input *PipedInput
+	// Transcript, if set, receives a copy of the command's output. Output of
+	// programs run on a pseudo-terminal is not copied, and in the persistent
+	// shell only stderr is.
+	Transcript io.Writer
+}
+
+// Programs that need a terminal to work properly
+var interactivePrograms = map[string]bool{
+	"vi": true, "vim": true, "nvim": true, "nano": true, "emacs": true, "pico": true, "micro": true,
+	"less": true, "more": true, "most": true, "man": true,
+	"top": true, "htop": true, "btop": true, "atop": true, "watch": true,
+	"ssh": true, "telnet": true, "ftp": true, "sftp": true, "mosh": true,
+	"tmux": true, "screen": true, "fzf": true, "passwd": true, "su": true, "sudo": true,
+	"mysql": true, "psql": true, "sqlite3": true, "redis-cli": true, "mongo": true, "mongosh": true,
+}
+
+// Interpreters that start a REPL when run without arguments
+var replPrograms = map[string]bool{
+	"python": true, "python3": true, "node": true, "irb": true, "ghci": true, "lua": true,
+	"bash": true, "zsh": true, "sh": true, "fish": true, "bc": true,
+}
+
+// isInteractiveCommand reports whether a command is known to need a terminal
+func isInteractiveCommand(command string) bool {
+	for _, cmd := range parseShellCommands(tokenizeShell(command)) {
+		args := cmd.args
+		for len(args) > 0 && isAssignment(args[0]) {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := filepath.Base(args[0])
+		switch {
+		case interactivePrograms[name]:
+			return true
+		case replPrograms[name] && len(args) == 1 && cmd.pipedFrom == nil && len(cmd.redirects) == 0:
+			return true
+		case name == "git" && len(args) > 1:
+			_, flags := splitFlags(args[2:])
+			switch args[1] {
+			case "add", "checkout", "reset", "stash":
+				if hasFlag(flags, "p", "i", "patch", "interactive") {
+					return true
+				}
+			case "rebase":
+				if hasFlag(flags, "i", "interactive") {
+					return true
+				}
+			case "commit":
+				if !hasFlag(flags, "m", "F", "message", "file", "no-edit") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ExecuteCommand executes a Unix command with session state persistence.
+// Output is streamed to the terminal as it is produced; the working directory
+// and environment are written to a temporary state file so they never mix
+// with the command's own output. Interactive programs are run on a
+// pseudo-terminal, and with execOpts.Persistent all commands whose output
+// isn't captured run in a long-lived shell shared by the session.
+func ExecuteCommandWithState(state *SessionState, command string, execOpts ExecOptions) error {
+	if command == "" {
+		return fmt.Errorf("no command generated")
+	}
+
+	if strings.TrimSpace(command) == "" {
+		return fmt.Errorf("empty command")
+	}
+
+	colorCommand.Printf("%s\n", command)
+	os.Stdout.Sync()
+
+	capture := execOpts.Stdout != nil || execOpts.Stderr != nil || execOpts.Input != nil
+	usePTY := !capture && isTerminal(os.Stdin) && isTerminal(os.Stdout) && (execOpts.ForcePTY || isInteractiveCommand(command))
+
+	ctx, stop := commandContext(execOpts.Timeout)
+	defer stop()
+
+	var stderr string
+	var runErr, err error
+	if execOpts.Persistent && !capture {
+		stderr, runErr, err = state.runPersistent(ctx, command, usePTY)
+		// The shell writes straight to the terminal, so only the stderr
+		// kept for error reporting can be copied
+		if execOpts.Transcript != nil {
+			io.WriteString(execOpts.Transcript, stderr)
+		}
+	} else {
+		stderr, runErr, err = runOnce(ctx, state, command, usePTY, execOpts)
+		// A running persistent shell no longer matches the session state
+		state.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+
+	if runErr != nil {
+		cmdErr := newCommandError(ctx, command, stderr, runErr)
+		cmdErr.Timeout = execOpts.Timeout
+		if cmdErr.Interrupted {
+			colorWarning.Fprintln(os.Stderr, "Command interrupted")
+		} else {
+			colorError.Fprintf(os.Stderr, "Command failed: %v\n", cmdErr)
+		}
+		os.Stderr.Sync()
+		return cmdErr
+	}
+
+	return nil
+}
+
+// commandContext returns a context that is cancelled with errCommandTimeout
+// once timeout elapses, or with errCommandInterrupted when uc receives
+// SIGINT. When the command is in the terminal's foreground group Ctrl-C
+// reaches it directly instead.
+func commandContext(timeout time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	stopTimer := func() bool { return false }
+	if timeout > 0 {
+		stopTimer = time.AfterFunc(timeout, func() { cancel(errCommandTimeout) }).Stop
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			cancel(errCommandInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		stopTimer()
+		signal.Stop(interrupt)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// stopProcessGroup asks the process group led by pid to stop because ctx was
+// cancelled, sending SIGINT for an interrupt and SIGTERM otherwise, and kills
+// whatever is left of the group after killGracePeriod unless the returned
+// timer is stopped
+func stopProcessGroup(ctx context.Context, pid int) *time.Timer {
+	sig := syscall.SIGTERM
+	if errors.Is(context.Cause(ctx), errCommandInterrupted) {
+		sig = syscall.SIGINT
+	}
+	signalProcessGroup(pid, sig)
+	return time.AfterFunc(killGracePeriod, func() {
+		signalProcessGroup(pid, syscall.SIGKILL)
+	})
+}
+
+// runOnce runs a command in a new shell process, on a pseudo-terminal if
+// usePTY is set and otherwise with the output, input and transcript given in
+// execOpts. It returns the tail of stderr and the command's error; err
+// reports a failure to set up the shell.
+func runOnce(ctx context.Context, state *SessionState, command string, usePTY bool, execOpts ExecOptions) (stderr string, runErr error, err error) {
+	shell := userShell()
+
+	stateDir, err := os.MkdirTemp("", "uc-state-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+	defer os.RemoveAll(stateDir)
+	envFile := filepath.Join(stateDir, "env")
+	shellFile := filepath.Join(stateDir, "shell")
+	kind := shellKind(shell)
+
+	// Build command that restores and captures state. The environment is
+	// passed directly; aliases, functions, options and umask are replayed
+	// first, and the trap records the final state even if the command calls
+	// exit.
+	trap, err := captureTrap(kind, envFile, shellFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not set up state capture: %v", err)
+	}
+	stateCommand := fmt.Sprintf("%s%s\ncd %s || exit 1\n%s\n", state.restoreScript(kind), trap, shellescape(state.WorkingDir), command)
+
+	cmd := exec.CommandContext(ctx, shell, "-c", stateCommand)
+	cmd.Env = state.Environ()
+	cmd.Cancel = func() error {
+		stopProcessGroup(ctx, cmd.Process.Pid)
+		return nil
+	}
+	// Don't wait for background jobs that keep the output open
+	cmd.WaitDelay = killGracePeriod
+
+	// Stream output live, keeping the tail of stderr for error reporting
+	stderrTail := &tailBuffer{max: MaxCapturedStderr}
+	if usePTY {
+		ptmx, tty, ptyErr := openPTY()
+		if ptyErr != nil {
+			colorWarning.Fprintf(os.Stderr, "Warning: could not allocate a pseudo-terminal: %v\n", ptyErr)
+			usePTY = false
+		} else {
+			runErr = runOnPTY(cmd, ptmx, tty)
+		}
+	}
+	if !usePTY {
+		// The command gets its own process group so it can be stopped as a
+		// whole; on a terminal it also becomes the foreground group
+		foreground := isTerminal(os.Stdin)
+		setProcessGroup(cmd, foreground)
+		if foreground {
+			cmd.Stdin = os.Stdin
+		}
+		if execOpts.Input != nil {
+			r, err := execOpts.Input.Open()
+			if err != nil {
+				return "", nil, fmt.Errorf("could not open piped input: %v", err)
+			}
+			stopInput, err := feedInput(cmd, r)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not open piped input: %v", err)
+			}
+			defer stopInput()
+		}
+		stdout, stderrOut := execOpts.Stdout, execOpts.Stderr
+		if stderrOut == nil {
+			stderrOut = os.Stderr
+		}
+		stderrWriters := []io.Writer{stderrOut, stderrTail}
+		waitOutput := func() {}
+		if transcript := execOpts.Transcript; transcript != nil {
+			stderrWriters = append(stderrWriters, transcript)
+			switch {
+			case stdout != nil:
+				stdout = io.MultiWriter(stdout, transcript)
+			case !isTerminal(os.Stdout):
+				stdout = io.MultiWriter(os.Stdout, transcript)
+			default:
+				// Mirror stdout through a pseudo-terminal so the command
+				// still sees a terminal and formats its output as usual
+				if tty, wait, err := mirrorOutput(transcript); err == nil {
+					stdout, waitOutput = tty, wait
+				}
+			}
+		}
+		if stdout == nil {
+			stdout = os.Stdout
+		}
+		cmd.Stdout = stdout
+		cmd.Stderr = io.MultiWriter(stderrWriters...)
+		runErr = cmd.Run()
+		waitOutput()
+		if foreground {
+			restoreForeground()
+		}
+	}
+	if errors.Is(runErr, exec.ErrWaitDelay) {
+		runErr = nil
+	}
+
+	// Update working directory and environment from the captured state
+	if loadErr := state.loadState(envFile); loadErr != nil && runErr == nil {
+		colorWarning.Fprintf(os.Stderr, "Warning: could not capture session state: %v\n", loadErr)
+	}
+	state.loadShellState(shellFile, kind)
+
+	return stderrTail.String(), runErr, nil
+}
+
+// CommandError describes a command that ran but did not succeed
+type CommandError struct {
+	Command string
+	// ExitCode is -1 if the command didn't exit normally
+	ExitCode int
+	// Signal is the signal that killed the command, or 0
+	Signal syscall.Signal
+	// TimedOut is set when the command was stopped after Timeout
+	TimedOut bool
+	Timeout  time.Duration
+	// Interrupted is set when the command was stopped with Ctrl-C
+	Interrupted bool
+	Stderr      string
+	Err         error
+}
+
+// newCommandError describes how a command run under ctx ended
+func newCommandError(ctx context.Context, command string, stderr string, runErr error) *CommandError {
+	e := &CommandError{Command: command, ExitCode: -1, Stderr: strings.TrimSpace(stderr), Err: runErr}
+
+	var exitErr *exec.ExitError
+	var statusErr exitStatusError
+	if errors.As(runErr, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			e.Signal = ws.Signal()
+			e.Interrupted = e.Signal == syscall.SIGINT
+		}
+	} else if errors.As(runErr, &statusErr) {
+		// The persistent shell reports a command killed by a signal as
+		// 128 plus the signal number
+		e.ExitCode = int(statusErr)
+		e.Interrupted = e.ExitCode == 128+int(syscall.SIGINT)
+	}
+
+	switch context.Cause(ctx) {
+	case errCommandTimeout:
+		e.TimedOut = true
+	case errCommandInterrupted:
+		e.Interrupted = true
+	}
+	return e
+}
+
+// Error implements the error interface
+func (e *CommandError) Error() string {
+	switch {
+	case e.TimedOut:
+		return fmt.Sprintf("timed out after %v", e.Timeout)
+	case e.Interrupted:
+		return "interrupted"
+	case e.Signal != 0:
+		return fmt.Sprintf("killed by signal: %v", e.Signal)
+	case e.ExitCode >= 0:
+		return fmt.Sprintf("exit code %d", e.ExitCode)
+	default:
+		return e.Err.Error()
+	}
+}
+
+// Unwrap returns the underlying exec error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// userShell returns the shell commands run in. The generated commands and the
+// state capture use POSIX syntax, so fish falls back to /bin/sh.
+func userShell() string {
+	// Get the user's current shell from environment variable
+	shell := os.Getenv("SHELL")
+	if shell == "" || filepath.Base(shell) == "fish" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
+
+// isTerminal reports whether f is connected to a terminal
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+// Write implements io.Writer
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.data = append(t.data, p...)
+	if len(t.data) > t.max {
+		t.data = t.data[len(t.data)-t.max:]
+	}
+	return len(p), nil
+}
+
+// String returns the retained bytes
+func (t *tailBuffer) String() string {
+	return string(t.data)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits on the local documentation sent along with an explain request
+const (
+	MaxDocsPerProgram = 1500
+	MaxDocsTotal      = 4000
+	docsTimeout       = 2 * time.Second
+	// docsContextLines is how many continuation lines follow a flag's entry
+	docsContextLines = 2
+)
+
+// --help is only run for programs installed in these directories, so that
+// explaining a command never runs a script that might ignore the flag
+var systemBinDirs = []string{
+	"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/usr/local/bin", "/usr/local/sbin",
+	"/opt/homebrew/bin", "/opt/homebrew/sbin",
+}
+
+// overstrike matches the backspace sequences man uses for bold and underline
+var overstrike = regexp.MustCompile(".\b")
+
+// programUse is a program in a command line and the flags it is given
+type programUse struct {
+	name  string
+	flags []string
+}
+
+// explainCommand asks the LLM to explain command and prints the explanation.
+// Ctrl-C cancels the request and returns errGenerationCancelled. If withDocs
+// is set, excerpts from local man pages or --help output for the programs
+// used are sent along with the command.
+func explainCommand(llmClient LLMClient, command string, workingDir string, withDocs bool) error {
+	request := &ExplainRequest{Command: command}
+	if withDocs {
+		request.Docs = commandDocs(command)
+	}
+
+	ctx, stop := commandContext(0)
+	defer stop()
+	s := createSpinner("Explaining command...")
+	s.Start()
+	explanation, err := llmClient.ExplainCommand(ctx, request)
+	s.Stop()
+	if errors.Is(context.Cause(ctx), errCommandInterrupted) {
+		return errGenerationCancelled
+	}
+	if err != nil {
+		return err
+	}
+	explanation = strings.TrimSpace(explanation)
+	if explanation == "" {
+		return fmt.Errorf("LLM returned an empty explanation")
+	}
+
+	colorCommand.Println(command)
+	showRisk(AnalyzeRisk(command, workingDir))
+	fmt.Println()
+	fmt.Println(explanation)
+	return nil
+}
+
+// looksLikeCommand reports whether text starts with a shell builtin or a
+// program that is installed or given by path, as a command to explain does
+func looksLikeCommand(text string) bool {
+	cmds := commandArgs(text)
+	if len(cmds) == 0 {
+		return false
+	}
+	name := cmds[0][0]
+	if strings.Contains(name, "/") || isShellBuiltin(name) {
+		return true
+	}
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// commandDocs collects documentation excerpts for the programs in command
+func commandDocs(command string) string {
+	var b strings.Builder
+	for _, use := range programsInCommand(command) {
+		excerpt, source := programDocs(use)
+		if excerpt == "" {
+			continue
+		}
+		section := fmt.Sprintf("--- %s (%s) ---\n%s\n", use.name, source, excerpt)
+		if b.Len()+len(section) > MaxDocsTotal {
+			break
+		}
+		b.WriteString(section)
+	}
+	return b.String()
+}
+
+// programsInCommand returns the programs run by command, including those run
+// by find -exec and substitutions, with the flags each is given, in order of
+// first use
+func programsInCommand(command string) []*programUse {
+	var uses []*programUse
+	byName := make(map[string]*programUse)
+	var add func(args []string)
+	add = func(args []string) {
+		args = stripCommandPrefixes(args, &RiskAssessment{})
+		if len(args) == 0 {
+			return
+		}
+		name := filepath.Base(args[0])
+		// Shell builtins have no man page of their own
+		if isShellBuiltin(name) || strings.ContainsAny(name, "$`=") {
+			return
+		}
+		use, ok := byName[name]
+		if !ok {
+			use = &programUse{name: name}
+			byName[name] = use
+			uses = append(uses, use)
+		}
+		rest := args[1:]
+		if name == "find" {
+			for i, arg := range rest {
+				if arg == "-exec" || arg == "-execdir" || arg == "-ok" || arg == "-okdir" {
+					add(findExecArgs(rest[i+1:]))
+				}
+			}
+		}
+		_, flags := splitFlags(rest)
+		use.flags = append(use.flags, flags...)
+	}
+	for _, cmd := range parseCommandLine(command) {
+		add(cmd.args)
+	}
+	return uses
+}
+
+// programDocs returns an excerpt of the documentation for a program and
+// where it came from, or "" if none is available
+func programDocs(use *programUse) (string, string) {
+	if text := runDocs("man", use.name); text != "" {
+		if excerpt := docsExcerpt(text, use.flags, true); excerpt != "" {
+			return excerpt, "man page"
+		}
+	}
+	// Programs such as reboot might act on --help instead of describing
+	// themselves, so only their man pages are used
+	if _, ok := highRiskCommands[use.name]; ok || strings.HasPrefix(use.name, "mkfs.") {
+		return "", ""
+	}
+	if _, ok := mediumRiskCommands[use.name]; ok {
+		return "", ""
+	}
+	path, err := exec.LookPath(use.name)
+	if err != nil || !inSystemBinDir(path) {
+		return "", ""
+	}
+	if text := runDocs(path, "--help"); text != "" {
+		return docsExcerpt(text, use.flags, false), "--help"
+	}
+	return "", ""
+}
+
+// runDocs runs a documentation command without a terminal or input and
+// returns its plain text output
+func runDocs(name string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), docsTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "MANPAGER=cat", "PAGER=cat", "MANWIDTH=80", "GROFF_NO_SGR=1", "LC_ALL=C")
+	// Many programs print usage and exit non-zero, so the output is kept
+	// unless the program had to be stopped
+	out, _ := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ""
+	}
+	return overstrike.ReplaceAllString(string(out), "")
+}
+
+// inSystemBinDir reports whether path is in one of systemBinDirs
+func inSystemBinDir(path string) bool {
+	dir := filepath.Dir(path)
+	for _, d := range systemBinDirs {
+		if dir == d {
+			return true
+		}
+	}
+	return false
+}
+
+// docsExcerpt picks the lines of text that describe the program and the
+// given flags: the NAME line of a man page or the first line of --help
+// output, and the entry of each flag with a few continuation lines
+func docsExcerpt(text string, flags []string, manPage bool) string {
+	lines := strings.Split(text, "\n")
+	keep := make([]bool, len(lines))
+
+	summary := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !manPage {
+			summary = i
+			break
+		}
+		if strings.TrimSpace(line) == "NAME" && i+1 < len(lines) {
+			summary = i + 1
+			break
+		}
+	}
+	if summary >= 0 {
+		keep[summary] = true
+	}
+
+	found := false
+	for _, key := range flagKeys(flags) {
+		for i, line := range lines {
+			if !isFlagEntry(strings.TrimSpace(line), key) {
+				continue
+			}
+			found = true
+			keep[i] = true
+			indent := leadingSpace(line)
+			for j := i + 1; j < len(lines) && j <= i+docsContextLines; j++ {
+				next := lines[j]
+				trimmed := strings.TrimSpace(next)
+				if trimmed == "" || strings.HasPrefix(trimmed, "-") || leadingSpace(next) <= indent {
+					break
+				}
+				keep[j] = true
+			}
+			break
+		}
+	}
+	if summary < 0 && !found {
+		return ""
+	}
+
+	var b strings.Builder
+	last := -1
+	for i, line := range lines {
+		if !keep[i] {
+			continue
+		}
+		if last >= 0 && i > last+1 {
+			b.WriteString("...\n")
+		}
+		line = strings.TrimRight(line, " \t") + "\n"
+		if b.Len()+len(line) > MaxDocsPerProgram {
+			break
+		}
+		b.WriteString(line)
+		last = i
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// flagKeys turns flags as written into the option names to look up: long
+// options lose their value, and grouped short options such as -la are looked
+// up both whole (as find's -mtime must be) and letter by letter
+func flagKeys(flags []string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	addKey := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, f := range flags {
+		if strings.HasPrefix(f, "--") {
+			addKey(strings.SplitN(f, "=", 2)[0])
+			continue
+		}
+		addKey(f)
+		if len(f) > 2 {
+			for _, r := range f[1:] {
+				if r >= '0' && r <= '9' {
+					break
+				}
+				addKey("-" + string(r))
+			}
+		}
+	}
+	return keys
+}
+
+// isFlagEntry reports whether a trimmed documentation line starts the entry
+// for key, e.g. "-l, --long" or "--color[=WHEN]"
+func isFlagEntry(line string, key string) bool {
+	if !strings.HasPrefix(line, key) {
+		return false
+	}
+	if len(line) == len(key) {
+		return true
+	}
+	return strings.ContainsRune(" \t,=[<", rune(line[len(key)]))
+}
+
+// leadingSpace returns the number of leading spaces and tabs in line
+func leadingSpace(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestLooksLikeCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"ls -la", true},
+		{" sudo ls /root", true},
+		{"cd /tmp && ls", true},
+		{"./configure --prefix=/usr", true},
+		{"the largest files here", false},
+		{"how to undo a git commit", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeCommand(tt.text); got != tt.want {
+			t.Errorf("looksLikeCommand(%q) = %t, want %t", tt.text, got, tt.want)
+		}
+	}
+}
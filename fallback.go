@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FallbackClient implements LLMClient over an ordered chain of providers.
+// Each request goes to the first provider and moves down the chain when a
+// provider can't be reached, times out, fails or gives an unusable answer.
+type FallbackClient struct {
+	Clients []LLMClient
+	// answered is the index of the client that gave the last answer, or -1
+	// before the first answer
+	answered int
+}
+
+// NewFallbackClient creates a FallbackClient that asks clients in order
+func NewFallbackClient(clients []LLMClient) *FallbackClient {
+	return &FallbackClient{Clients: clients, answered: -1}
+}
+
+// GenerateCommand implements LLMClient for a provider chain
+func (f *FallbackClient) GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error) {
+	return f.command(ctx, nil, func(client LLMClient, onText func(string)) (*CommandResponse, error) {
+		return client.GenerateCommand(ctx, request)
+	})
+}
+
+// RepairCommand implements LLMClient for a provider chain
+func (f *FallbackClient) RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error) {
+	return f.command(ctx, nil, func(client LLMClient, onText func(string)) (*CommandResponse, error) {
+		return client.RepairCommand(ctx, repair)
+	})
+}
+
+// StreamCommand implements StreamingLLMClient for a provider chain. Providers
+// that can't stream answer in one piece.
+func (f *FallbackClient) StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error) {
+	return f.command(ctx, onText, func(client LLMClient, onText func(string)) (*CommandResponse, error) {
+		if streamer, ok := client.(StreamingLLMClient); ok {
+			return streamer.StreamCommand(ctx, request, onText)
+		}
+		return client.GenerateCommand(ctx, request)
+	})
+}
+
+// StreamRepair implements StreamingLLMClient for a provider chain
+func (f *FallbackClient) StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error) {
+	return f.command(ctx, onText, func(client LLMClient, onText func(string)) (*CommandResponse, error) {
+		if streamer, ok := client.(StreamingLLMClient); ok {
+			return streamer.StreamRepair(ctx, repair, onText)
+		}
+		return client.RepairCommand(ctx, repair)
+	})
+}
+
+// command asks each client in turn for a command until one answers with a
+// non-empty one. Once part of an answer has been streamed to onText, a
+// failure is returned as is, since the next provider's answer would be
+// shown mixed with it.
+func (f *FallbackClient) command(ctx context.Context, onText func(string), ask func(client LLMClient, onText func(string)) (*CommandResponse, error)) (*CommandResponse, error) {
+	var failures []string
+	for i, client := range f.Clients {
+		streamed := false
+		response, err := ask(client, func(text string) {
+			if text != "" {
+				streamed = true
+			}
+			if onText != nil {
+				onText(text)
+			}
+		})
+		if err == nil && strings.TrimSpace(response.Command) == "" {
+			err = fmt.Errorf("%s returned an empty command", client.GetProviderInfo())
+		}
+		if err == nil {
+			f.answered = i
+			return response, nil
+		}
+		if streamed || !canFallBack(ctx, err) {
+			return nil, err
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, fmt.Errorf("no provider could answer: %s", strings.Join(failures, "; "))
+}
+
+// GenerateCandidates implements CandidateLLMClient for a provider chain,
+// asking each provider the way it supports best
+func (f *FallbackClient) GenerateCandidates(ctx context.Context, request *CommandRequest, n int) ([]*CommandResponse, error) {
+	var failures []string
+	for i, client := range f.Clients {
+		responses, err := generateCandidates(ctx, client, request, n)
+		if err == nil && !anyCommand(responses) {
+			err = fmt.Errorf("%s returned an empty command", client.GetProviderInfo())
+		}
+		if err == nil {
+			f.answered = i
+			return responses, nil
+		}
+		if !canFallBack(ctx, err) {
+			return nil, err
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, fmt.Errorf("no provider could answer: %s", strings.Join(failures, "; "))
+}
+
+// anyCommand reports whether one of responses has a non-empty command
+func anyCommand(responses []*CommandResponse) bool {
+	for _, response := range responses {
+		if strings.TrimSpace(response.Command) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ExplainCommand implements LLMClient for a provider chain
+func (f *FallbackClient) ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error) {
+	var failures []string
+	for i, client := range f.Clients {
+		explanation, err := client.ExplainCommand(ctx, explain)
+		if err == nil && strings.TrimSpace(explanation) == "" {
+			err = fmt.Errorf("%s returned an empty explanation", client.GetProviderInfo())
+		}
+		if err == nil {
+			f.answered = i
+			return explanation, nil
+		}
+		if !canFallBack(ctx, err) {
+			return "", err
+		}
+		failures = append(failures, err.Error())
+	}
+	return "", fmt.Errorf("no provider could answer: %s", strings.Join(failures, "; "))
+}
+
+// canFallBack reports whether the next provider should be asked after err.
+// Requests the user cancelled are not, and neither are answers withheld by
+// a safety filter or refused, which other providers shouldn't be used to
+// work around.
+func canFallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	return !errors.As(err, &apiErr) || apiErr.Kind != APIErrorBlocked
+}
+
+// GetProviderInfo returns the provider that gave the last answer, or the
+// whole chain before the first answer
+func (f *FallbackClient) GetProviderInfo() string {
+	switch {
+	case f.answered == 0:
+		return f.Clients[0].GetProviderInfo()
+	case f.answered > 0:
+		return fmt.Sprintf("%s (fallback from %s)", f.Clients[f.answered].GetProviderInfo(), f.Clients[0].GetProviderInfo())
+	}
+	var chain []string
+	for _, client := range f.Clients {
+		chain = append(chain, client.GetProviderInfo())
+	}
+	return strings.Join(chain, ", then ")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ollamaAnswer is an Ollama chat response whose message is a command answer
+func ollamaAnswer(command string) string {
+	return fmt.Sprintf(`{"message":{"content":%q},"done":true}`, fmt.Sprintf(`{"command":%q,"explanation":"test"}`, command))
+}
+
+// answering returns a handler for a fake Ollama provider that answers with
+// command
+func answering(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, ollamaAnswer(command))
+	}
+}
+
+// newFallbackProvider starts a fake Ollama provider called model and returns
+// a client for it and the number of requests it has received
+func newFallbackProvider(t *testing.T, model string, handler http.HandlerFunc) (*OllamaClient, *atomic.Int32) {
+	t.Helper()
+	server, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		handler(w, r)
+	})
+	client := server.Client()
+	client.Timeout = 200 * time.Millisecond
+	return &OllamaClient{URL: server.URL, Model: model, HTTPClient: client}, requests
+}
+
+// unreachableURL returns the address of a server that has been shut down
+func unreachableURL() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func TestFallbackClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// first handles requests to the first provider
+		first http.HandlerFunc
+		// unreachable replaces the first provider's address with one
+		// nothing listens on
+		unreachable bool
+		stream      bool
+		want        string
+		err         string
+		// fellBack is set if the second provider must have been asked
+		fellBack bool
+	}{
+		{
+			name:  "first provider answers",
+			first: answering("ls"),
+			want:  "ls",
+		},
+		{
+			name:        "first provider is unreachable",
+			unreachable: true,
+			want:        "pwd",
+			fellBack:    true,
+		},
+		{
+			name: "first provider times out",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				// The client hanging up is only noticed once the body is read
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+			},
+			want:     "pwd",
+			fellBack: true,
+		},
+		{
+			name: "first provider fails",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+			},
+			want:     "pwd",
+			fellBack: true,
+		},
+		{
+			name:     "first provider gives an empty command",
+			first:    answering(" "),
+			want:     "pwd",
+			fellBack: true,
+		},
+		{
+			name: "first provider gives an unusable answer",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"message":{"content":""},"done":true}`)
+			},
+			want:     "pwd",
+			fellBack: true,
+		},
+		{
+			name:   "first provider streams an answer",
+			first:  answering("ls"),
+			stream: true,
+			want:   "ls",
+		},
+		{
+			name: "first provider fails before streaming",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, `{"error":"out of memory"}`)
+			},
+			stream:   true,
+			want:     "pwd",
+			fellBack: true,
+		},
+		{
+			name: "first provider fails after streaming",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, `{"message":{"content":"{\"command\":"}}`)
+				fmt.Fprintln(w, `{"error":"out of memory"}`)
+			},
+			stream: true,
+			err:    "out of memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Building a prompt loads the config, which is created if missing
+			t.Setenv("HOME", t.TempDir())
+			first, _ := newFallbackProvider(t, "first", tt.first)
+			if tt.unreachable {
+				first.URL = unreachableURL()
+			}
+			second, requests := newFallbackProvider(t, "second", answering("pwd"))
+			f := NewFallbackClient([]LLMClient{first, second})
+
+			request := &CommandRequest{Request: "list files"}
+			var response *CommandResponse
+			var err error
+			if tt.stream {
+				response, err = f.StreamCommand(context.Background(), request, func(string) {})
+			} else {
+				response, err = f.GenerateCommand(context.Background(), request)
+			}
+
+			switch {
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want one containing %q", err, tt.err)
+				}
+			case err != nil:
+				t.Errorf("request failed: %v", err)
+			case response.Command != tt.want:
+				t.Errorf("command = %q, want %q", response.Command, tt.want)
+			}
+			if asked := requests.Load() > 0; asked != tt.fellBack {
+				t.Errorf("second provider asked = %t, want %t", asked, tt.fellBack)
+			}
+		})
+	}
+}
+
+func TestFallbackClientBlocked(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[{"message":{"refusal":"I can't help with that"}}]}`)
+	}))
+	defer server.Close()
+	first := &OpenAIClient{APIKey: "key", Model: "first", BaseURL: server.URL, HTTPClient: server.Client()}
+	second, requests := newFallbackProvider(t, "second", answering("pwd"))
+	f := NewFallbackClient([]LLMClient{first, second})
+
+	_, err := f.GenerateCommand(context.Background(), &CommandRequest{Request: "delete everything"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != APIErrorBlocked {
+		t.Errorf("error = %v, want the first provider's refusal", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("second provider was asked %d times after a refusal, want 0", n)
+	}
+}
+
+func TestFallbackClientAllFail(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	first := &OllamaClient{URL: unreachableURL(), Model: "first", HTTPClient: http.DefaultClient}
+	second, _ := newFallbackProvider(t, "second", answering(""))
+	f := NewFallbackClient([]LLMClient{first, second})
+
+	_, err := f.GenerateCommand(context.Background(), &CommandRequest{Request: "list files"})
+	if err == nil || !strings.HasPrefix(err.Error(), "no provider could answer: ") || !strings.Contains(err.Error(), "failed to call Ollama API") || !strings.Contains(err.Error(), "LLM returned no command") {
+		t.Errorf("error = %v, want the failures of both providers", err)
+	}
+}
+
+func TestFallbackClientProviderInfo(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var firstDown atomic.Bool
+	first, _ := newFallbackProvider(t, "first", func(w http.ResponseWriter, r *http.Request) {
+		if firstDown.Load() {
+			http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+			return
+		}
+		answering("ls")(w, r)
+	})
+	second, _ := newFallbackProvider(t, "second", answering("pwd"))
+	f := NewFallbackClient([]LLMClient{first, second})
+
+	if got, want := f.GetProviderInfo(), "Ollama (first), then Ollama (second)"; got != want {
+		t.Errorf("before any answer GetProviderInfo = %q, want %q", got, want)
+	}
+
+	steps := []struct {
+		firstDown bool
+		want      string
+	}{
+		{false, "Ollama (first)"},
+		{true, "Ollama (second) (fallback from Ollama (first))"},
+		{false, "Ollama (first)"},
+	}
+	for _, step := range steps {
+		firstDown.Store(step.firstDown)
+		if _, err := f.GenerateCommand(context.Background(), &CommandRequest{Request: "list files"}); err != nil {
+			t.Fatalf("GenerateCommand failed: %v", err)
+		}
+		if got := f.GetProviderInfo(); got != step.want {
+			t.Errorf("with first provider down = %t GetProviderInfo = %q, want %q", step.firstDown, got, step.want)
+		}
+	}
+}
@@ -8,11 +8,11 @@ require (
 	github.com/briandowns/spinner v1.23.2
 	github.com/chzyer/readline v1.5.1
 	github.com/fatih/color v1.18.0
+	golang.org/x/sys v0.32.0
+	golang.org/x/term v0.1.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.32.0 // indirect
-	golang.org/x/term v0.1.0 // indirect
 )
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default limits for LLM requests
+const (
+	DefaultRequestTimeout = 120 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+)
+
+// newHTTPClient creates the HTTP client shared by all requests to the LLM
+// provider, applying the configured timeouts, proxy and CA bundle
+func newHTTPClient(config *Config) (*http.Client, error) {
+	connectTimeout := configTimeout(config.ConnectTimeout, DefaultConnectTimeout)
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if config.Proxy != "" {
+		proxyURL, err := parseProxyURL(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   configTimeout(config.RequestTimeout, DefaultRequestTimeout),
+	}, nil
+}
+
+// configTimeout converts a timeout in seconds from the configuration, where
+// 0 means fallback and a negative value means no limit
+func configTimeout(seconds int, fallback time.Duration) time.Duration {
+	switch {
+	case seconds == 0:
+		return fallback
+	case seconds < 0:
+		return 0
+	default:
+		return time.Duration(seconds) * time.Second
+	}
+}
+
+// parseProxyURL parses the proxy option, which may leave out the http://
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s", proxy)
+	}
+	return proxyURL, nil
+}
+
+// loadCABundle returns the system certificate pool with the certificates in
+// the PEM file at path added
+func loadCABundle(path string) (*x509.CertPool, error) {
+	if strings.HasPrefix(path, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("could not get home directory: %v", err)
+		}
+		path = filepath.Join(homeDir, path[2:])
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on how much piped data is shown to the LLM
+const (
+	MaxInputSampleBytes = 4096
+	MaxInputSampleLines = 40
+	// inputSampleWait bounds how long uc waits for piped data to sample, so
+	// that a producer that keeps running, such as tail -f, doesn't hold up
+	// generation
+	inputSampleWait = 2 * time.Second
+)
+
+// errInputStopped is returned by inputStream.read once it is told to stop
+var errInputStopped = errors.New("stopped reading piped input")
+
+// InputSample describes data piped to uc without including all of it
+type InputSample struct {
+	// Head holds the first lines of the data, empty for binary data
+	Head string
+	// Size is the total size of the data in bytes
+	Size int64
+	// Truncated is set when Head is not the whole input
+	Truncated bool
+	// Binary is set when the data does not look like text
+	Binary bool
+	// More is set when the data was still arriving after sampling, so its
+	// total size is unknown and Size only counts what was read so far
+	More bool
+}
+
+// describe returns the prompt text telling the LLM about the data
+func (s *InputSample) describe() string {
+	switch {
+	case s.Binary && s.More:
+		return "The command will receive binary data on standard input."
+	case s.Binary:
+		return fmt.Sprintf("The command will receive %d bytes of binary data on standard input.", s.Size)
+	case s.Size == 0 && s.More:
+		return "The command will receive data on standard input that hasn't started arriving yet. It must read the data from stdin rather than a file."
+	case s.Size == 0:
+		return "The command will receive empty standard input."
+	case s.More:
+		return fmt.Sprintf("The command will receive more data on standard input than has been read so far, so its total size is unknown; it may be large or a stream that never ends (only the beginning is shown). It must read the data from stdin rather than a file:\n%s", s.Head)
+	}
+	shown := "all of it is shown"
+	if s.Truncated {
+		shown = "only the beginning is shown"
+	}
+	return fmt.Sprintf("The command will receive %d bytes of data on standard input (%s). It must read the data from stdin rather than a file:\n%s", s.Size, shown, s.Head)
+}
+
+// PipedInput holds data piped to uc. Only the head is read up front for the
+// sample; the rest is passed on while the command reads it. If the input is
+// to be replayed for a repaired command, what the command reads is spooled
+// to a temporary file.
+type PipedInput struct {
+	Sample *InputSample
+	// head is the data read while sampling
+	head []byte
+	// rest delivers the data after head, nil if head is all of it
+	rest *inputStream
+	// spool keeps a copy of the data read from rest, if set
+	spool *os.File
+	// used is set once rest has been handed to a command
+	used bool
+}
+
+// readPipedInput samples the head of r. If replay is set, the data can be
+// opened again for another command.
+func readPipedInput(r io.Reader, replay bool) (*PipedInput, error) {
+	stream := newInputStream(r)
+	head, err := stream.sample(MaxInputSampleBytes, inputSampleWait)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	input := &PipedInput{head: head}
+	more := err == nil
+	if more {
+		input.rest = stream
+		if replay {
+			if input.spool, err = os.CreateTemp("", "uc-stdin-*"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	input.Sample = sampleInput(head, int64(len(head)), more)
+	return input, nil
+}
+
+// sampleInput keeps at most MaxInputSampleLines whole lines of head. more
+// is set if data may follow the size bytes read so far.
+func sampleInput(head []byte, size int64, more bool) *InputSample {
+	sample := &InputSample{Size: size, More: more}
+	if bytes.IndexByte(head, 0) >= 0 {
+		sample.Binary = true
+		return sample
+	}
+
+	truncated := int64(len(head)) < size || more
+	if truncated {
+		// Drop the partial last line
+		if i := bytes.LastIndexByte(head, '\n'); i >= 0 {
+			head = head[:i+1]
+		}
+		// Don't mistake a character cut in half for binary data
+		for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+	if !utf8.Valid(head) {
+		sample.Binary = true
+		return sample
+	}
+
+	lines := strings.SplitAfter(string(head), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > MaxInputSampleLines {
+		lines = lines[:MaxInputSampleLines]
+		truncated = true
+	}
+	sample.Head = strings.Join(lines, "")
+	if !strings.HasSuffix(sample.Head, "\n") && sample.Head != "" {
+		sample.Head += "\n"
+	}
+	sample.Truncated = truncated
+	return sample
+}
+
+// Open returns a reader for the data from the start, for the next command.
+// Closing it stops reading, leaving the data the command didn't read for
+// the next one. Live data that isn't spooled can only be opened once.
+func (p *PipedInput) Open() (io.ReadCloser, error) {
+	if p.rest == nil {
+		return io.NopCloser(bytes.NewReader(p.head)), nil
+	}
+	if p.used && p.spool == nil {
+		return nil, fmt.Errorf("piped input was already read by an earlier command")
+	}
+	p.used = true
+
+	r := &inputReader{stream: p.rest, stop: make(chan struct{})}
+	readers := []io.Reader{bytes.NewReader(p.head)}
+	var rest io.Reader = r
+	if p.spool != nil {
+		spooled, err := p.spool.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, io.NewSectionReader(p.spool, 0, spooled))
+		rest = io.TeeReader(r, p.spool)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(append(readers, rest)...), r}, nil
+}
+
+// Close removes the spooled data
+func (p *PipedInput) Close() {
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+	}
+}
+
+// inputStream reads piped data in the background, so that a reader can stop
+// without waiting for a producer that has nothing more to say
+type inputStream struct {
+	chunks chan []byte
+	// err ended the data, and is set before chunks is closed
+	err error
+	// pending is the part of the last chunk that hasn't been read yet
+	pending []byte
+}
+
+// newInputStream starts reading r
+func newInputStream(r io.Reader) *inputStream {
+	s := &inputStream{chunks: make(chan []byte)}
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.chunks <- buf[:n]
+			}
+			if err != nil {
+				s.err = err
+				close(s.chunks)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// read reads from the stream, or returns errInputStopped once stop is closed
+func (s *inputStream) read(b []byte, stop <-chan struct{}) (int, error) {
+	if len(s.pending) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, s.err
+			}
+			s.pending = chunk
+		case <-stop:
+			return 0, errInputStopped
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// sample reads up to max bytes, stopping early after wait. It returns
+// io.EOF if that was all of the data.
+func (s *inputStream) sample(max int, wait time.Duration) ([]byte, error) {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(wait, func() { close(stop) })
+	defer timer.Stop()
+
+	head := make([]byte, 0, max)
+	for len(head) < max {
+		n, err := s.read(head[len(head):max], stop)
+		head = head[:len(head)+n]
+		if err == errInputStopped {
+			break
+		}
+		if err != nil {
+			return head, err
+		}
+	}
+	return head, nil
+}
+
+// inputReader reads the rest of a PipedInput for one command
+type inputReader struct {
+	stream *inputStream
+	stop   chan struct{}
+}
+
+// Read implements io.Reader, ending the data once the reader is closed
+func (r *inputReader) Read(b []byte) (int, error) {
+	n, err := r.stream.read(b, r.stop)
+	if err == errInputStopped {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close stops reading
+func (r *inputReader) Close() error {
+	close(r.stop)
+	return nil
+}
+
+// feedInput passes r to cmd's stdin through a pipe. The returned function
+// must be called once the command has exited; it stops the copy and closes
+// r.
+func feedInput(cmd *exec.Cmd, r io.ReadCloser) (stop func(), err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	cmd.Stdin = pr
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(pw, r)
+		pw.Close()
+		close(done)
+	}()
+
+	return func() {
+		// Closing the read end fails a write the command will never read
+		pr.Close()
+		r.Close()
+		<-done
+	}, nil
+}
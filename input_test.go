@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPipedInputLiveData(t *testing.T) {
+	for _, replay := range []bool{false, true} {
+		pr, pw := io.Pipe()
+		first := strings.Repeat("line of data\n", MaxInputSampleBytes/10)
+		release := make(chan struct{})
+		go func() {
+			pw.Write([]byte(first))
+			// Keep the producer running until the first command is done
+			<-release
+			pw.Write([]byte("last line\n"))
+			pw.Close()
+		}()
+
+		input, err := readPipedInput(pr, replay)
+		if err != nil {
+			t.Fatalf("readPipedInput failed: %v", err)
+		}
+		defer input.Close()
+		if !input.Sample.More || !input.Sample.Truncated || input.Sample.Size != MaxInputSampleBytes {
+			t.Errorf("sample = %+v, want more data after %d bytes", input.Sample, MaxInputSampleBytes)
+		}
+
+		// The first command reads everything sent so far and exits while
+		// the producer is still running
+		r, err := input.Open()
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		got := make([]byte, len(first))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != first {
+			t.Fatalf("first read = %q, %v", got, err)
+		}
+		r.Close()
+		if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("read after Close = %d, %v, want io.EOF", n, err)
+		}
+		close(release)
+
+		r, err = input.Open()
+		if !replay {
+			if err == nil {
+				t.Error("opening live input twice without replay succeeded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("second Open failed: %v", err)
+		}
+		all, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(all) != first+"last line\n" {
+			t.Errorf("replayed input = %d bytes, %v, want all %d bytes", len(all), err, len(first)+len("last line\n"))
+		}
+	}
+}
+
+func TestPipedInputComplete(t *testing.T) {
+	input, err := readPipedInput(strings.NewReader("a\nb\n"), false)
+	if err != nil {
+		t.Fatalf("readPipedInput failed: %v", err)
+	}
+	defer input.Close()
+	if input.Sample.More || input.Sample.Truncated || input.Sample.Head != "a\nb\n" || input.Sample.Size != 4 {
+		t.Errorf("sample = %+v, want all of the data", input.Sample)
+	}
+
+	// Data read in full can be opened any number of times
+	for i := 0; i < 2; i++ {
+		r, err := input.Open()
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		var got bytes.Buffer
+		io.Copy(&got, r)
+		r.Close()
+		if got.String() != "a\nb\n" {
+			t.Errorf("read %q, want all of the data", got.String())
+		}
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,7 +13,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/briandowns/spinner"
@@ -22,26 +26,58 @@ import (
 // Constants
 const (
 	// Default configuration values
-	DefaultProvider    = "ollama"
-	DefaultOllamaURL   = "http://localhost:11434"
-	DefaultOllamaModel = "llama3.2"
-	DefaultOpenAIModel = "gpt-4.1-mini"
-	DefaultGeminiModel = "gemini-2.5-flash"
-	DefaultConfigFile  = ".uc.json"
-	DefaultHistoryFile = ".uc_history"
-	DefaultPromptFile  = "uc.prompts"
+	DefaultProvider       = "ollama"
+	DefaultOllamaURL      = "http://localhost:11434"
+	DefaultOllamaModel    = "llama3.2"
+	DefaultOpenAIModel    = "gpt-4.1-mini"
+	DefaultOpenAIBaseURL  = "https://api.openai.com/v1"
+	DefaultGeminiModel    = "gemini-2.5-flash"
+	DefaultGeminiURL      = "https://generativelanguage.googleapis.com"
+	DefaultAnthropicURL   = "https://api.anthropic.com"
+	DefaultAnthropicModel = "claude-haiku-4-5"
+	DefaultConfigFile     = ".uc.json"
+	DefaultHistoryFile    = ".uc_history"
+	DefaultPromptFile     = "uc.prompts"
 
 	// Interactive commands
 	CmdHelp   = "help"
 	CmdExit   = "exit"
 	CmdDryRun = "dryrun"
+	CmdReview = "review"
+	CmdPTY    = "pty"
+	CmdReset  = "reset"
+
+	// Subcommands; explain also works in interactive mode
+	CmdInit    = "init"
+	CmdExplain = "explain"
 
 	// Prompts
 	NormalPrompt = "uc> "
+	ReviewPrompt = "run> "
 
 	// Spinner configuration
 	SpinnerIndex = 14
 	SpinnerDelay = 100 * time.Millisecond
+
+	// MaxRepairStderr limits how much error output is sent back to the LLM
+	MaxRepairStderr = 2000
+
+	// MaxExplainTokens limits the length of a command explanation
+	MaxExplainTokens = 1024
+)
+
+// Exit codes in single-command mode. A command that ran and failed passes its
+// own exit code through; uc's own failures use the sysexits(3) values.
+const (
+	ExitOK               = 0
+	ExitUsage            = 64  // EX_USAGE: invalid command-line arguments
+	ExitGenerationFailed = 69  // EX_UNAVAILABLE: the LLM gave no usable command
+	ExitSystemError      = 71  // EX_OSERR: the command could not be started
+	ExitRefused          = 77  // EX_NOPERM: refused by the risk policy
+	ExitConfigError      = 78  // EX_CONFIG: invalid configuration
+	ExitTimeout          = 124 // the command timed out, as with timeout(1)
+	ExitSignalBase       = 128 // plus the signal number for killed commands
+	ExitCancelled        = 130 // cancelled by the user or interrupted
 )
 
 // Color functions using github.com/fatih/color
@@ -59,7 +95,7 @@ var (
 
 // createSpinner creates and configures a new spinner
 func createSpinner(message string) *spinner.Spinner {
-	s := spinner.New(spinner.CharSets[SpinnerIndex], SpinnerDelay)
+	s := spinner.New(spinner.CharSets[SpinnerIndex], SpinnerDelay, spinner.WithWriterFile(os.Stderr))
 	s.Suffix = " " + message
 	s.Color("cyan")
 	return s
@@ -67,38 +103,234 @@ func createSpinner(message string) *spinner.Spinner {
 
 // Config holds the application configuration
 type Config struct {
-	Provider      string `json:"provider"`
-	OllamaURL     string `json:"ollama_url"`
-	OllamaModel   string `json:"ollama_model"`
-	OpenAIKey     string `json:"openai_key"`
-	OpenAIModel   string `json:"openai_model"`
-	GeminiKey     string `json:"gemini_key"`
-	GeminiModel   string `json:"gemini_model"`
-	SysPromptFile string `json:"sys_prompt_file"`
+	Provider    string `json:"provider"`
+	OllamaURL   string `json:"ollama_url"`
+	OllamaModel string `json:"ollama_model"`
+	OpenAIKey   string `json:"openai_key"`
+	OpenAIModel string `json:"openai_model"`
+	// OpenAI-compatible servers (vLLM, LM Studio, LiteLLM, gateways)
+	OpenAIBaseURL      string            `json:"openai_base_url,omitempty"`
+	OpenAIHeaders      map[string]string `json:"openai_headers,omitempty"`
+	OpenAIOrganization string            `json:"openai_organization,omitempty"`
+	OpenAIProject      string            `json:"openai_project,omitempty"`
+	OpenAIAuthScheme   string            `json:"openai_auth_scheme,omitempty"`
+	GeminiKey          string            `json:"gemini_key"`
+	GeminiModel        string            `json:"gemini_model"`
+	GeminiURL          string            `json:"gemini_url"`
+	AnthropicKey       string            `json:"anthropic_key"`
+	AnthropicModel     string            `json:"anthropic_model"`
+	AnthropicURL       string            `json:"anthropic_url"`
+	SysPromptFile      string            `json:"sys_prompt_file"`
+	// RepairAttempts is how many times a failed command is sent back to the
+	// LLM for a fix; 0 disables the repair loop
+	RepairAttempts int `json:"repair_attempts,omitempty"`
+	// PersistentShell runs every command of a session in one long-lived
+	// shell instead of starting a new shell per command
+	PersistentShell bool `json:"persistent_shell,omitempty"`
+	// CommandTimeout stops commands that run longer than this many seconds;
+	// 0 means no limit
+	CommandTimeout int `json:"command_timeout,omitempty"`
+	// MemoryTokens is the budget for earlier requests remembered in
+	// interactive mode; 0 means DefaultMemoryTokens and a negative value
+	// turns memory off
+	MemoryTokens int `json:"memory_tokens,omitempty"`
+	// RequestTimeout and ConnectTimeout limit LLM requests, in seconds; 0
+	// means the default and a negative value means no limit
+	RequestTimeout int `json:"request_timeout,omitempty"`
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	// Proxy is the proxy URL for LLM requests, overriding HTTP_PROXY and
+	// HTTPS_PROXY
+	Proxy string `json:"proxy,omitempty"`
+	// CABundle is a PEM file of extra certificate authorities to trust, such
+	// as the one of a TLS-intercepting corporate proxy
+	CABundle string `json:"ca_bundle,omitempty"`
+	// Providers is an ordered fallback chain used instead of Provider, such
+	// as ["ollama", "openai_compatible", "gemini"]
+	Providers []string `json:"providers,omitempty"`
+	// Candidates is how many alternative commands to ask for per request;
+	// 0 or 1 means a single command
+	Candidates int `json:"candidates,omitempty"`
 }
 
-// LLMClient interface for different LLM providers
+// LLMClient interface for different LLM providers. Requests stop early when
+// ctx is cancelled.
 type LLMClient interface {
-	GenerateCommand(naturalLanguage string) (string, error)
+	GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error)
+	RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error)
+	ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error)
 	GetProviderInfo() string
 }
 
+// StreamingLLMClient is an LLMClient that can also deliver its answer as it
+// is generated. onText is called with each piece of the raw response as it
+// arrives, and generation stops early when ctx is cancelled.
+type StreamingLLMClient interface {
+	LLMClient
+	StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error)
+	StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error)
+}
+
+// CommandRequest is a natural language request the LLM turns into a command
+type CommandRequest struct {
+	Request string
+	// Input describes data piped to uc that the command will read, if any
+	Input *InputSample
+	// History holds earlier requests in the session, if any
+	History *Conversation
+}
+
+// RepairRequest describes a failed command the LLM is asked to correct
+type RepairRequest struct {
+	Request  string
+	Command  string
+	ExitCode int
+	Stderr   string
+	Input    *InputSample
+	History  *Conversation
+}
+
+// ExplainRequest is an existing command the LLM is asked to explain
+type ExplainRequest struct {
+	Command string
+	// Docs holds man page or --help excerpts for the programs used, if any
+	Docs string
+}
+
 // OllamaClient implements LLMClient for Ollama
 type OllamaClient struct {
-	URL   string
-	Model string
+	URL        string
+	Model      string
+	HTTPClient *http.Client
+}
+
+// ollamaChatRequest is the body of an Ollama chat request
+type ollamaChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []ChatMessage `json:"messages"`
+	// Stream must be set explicitly as Ollama streams by default
+	Stream bool                   `json:"stream"`
+	Format map[string]interface{} `json:"format,omitempty"`
+}
+
+// ollamaChatResponse is an Ollama chat response, or one line of a streamed
+// response
+type ollamaChatResponse struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done  bool   `json:"done"`
+	Error string `json:"error"`
 }
 
-// OpenAIClient implements LLMClient for OpenAI
+// OpenAIClient implements LLMClient for OpenAI and any server that speaks
+// the Chat Completions protocol
 type OpenAIClient struct {
-	APIKey string
-	Model  string
+	APIKey       string
+	Model        string
+	BaseURL      string
+	Headers      map[string]string
+	Organization string
+	Project      string
+	// AuthScheme is "bearer" (default), "api-key", "none", or a custom
+	// Authorization scheme such as "Token"
+	AuthScheme string
+	// Compatible marks a non-OpenAI server for display purposes
+	Compatible bool
+	HTTPClient *http.Client
+}
+
+// openAIChatRequest is the body of a Chat Completions request
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []ChatMessage         `json:"messages"`
+	MaxTokens      int                   `json:"max_tokens"`
+	N              int                   `json:"n,omitempty"`
+	Stream         bool                  `json:"stream,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+// openAIResponseFormat asks for an answer matching a JSON schema
+type openAIResponseFormat struct {
+	Type       string           `json:"type"`
+	JSONSchema openAIJSONSchema `json:"json_schema"`
+}
+
+// openAIJSONSchema is a named schema for structured outputs
+type openAIJSONSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// openAIChatResponse is a Chat Completions response, or one event of a
+// streamed response, where choices carry a delta instead of a message
+type openAIChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+			Refusal string `json:"refusal"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+			Refusal string `json:"refusal"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Error *apiErrorDetail `json:"error"`
 }
 
 // GeminiClient implements LLMClient for Google Gemini
 type GeminiClient struct {
-	APIKey string
-	Model  string
+	APIKey     string
+	Model      string
+	URL        string
+	HTTPClient *http.Client
+}
+
+// geminiRequest is the body of a generateContent request
+type geminiRequest struct {
+	SystemInstruction geminiContent           `json:"systemInstruction"`
+	Contents          []geminiContent         `json:"contents"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// geminiContent is a message in a Gemini conversation
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+// geminiPart is a piece of a message
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+// geminiGenerationConfig asks for an answer matching a schema
+type geminiGenerationConfig struct {
+	ResponseMimeType string                 `json:"responseMimeType"`
+	ResponseSchema   map[string]interface{} `json:"responseSchema"`
+	CandidateCount   int                    `json:"candidateCount,omitempty"`
+}
+
+// geminiResponse is a generateContent response, or one event of a streamed
+// response
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+}
+
+// geminiBlockReasons are the finish reasons of answers withheld by Gemini
+var geminiBlockReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
 }
 
 // LoadConfig loads configuration from .uc.json file
@@ -149,14 +381,18 @@ func createDefaultConfig(configFile string) error {
 	sysPromptFile := filepath.Join(homeDir, DefaultPromptFile)
 
 	defaultConfig := Config{
-		Provider:      DefaultProvider,
-		OllamaURL:     DefaultOllamaURL,
-		OllamaModel:   DefaultOllamaModel,
-		OpenAIKey:     "",
-		OpenAIModel:   DefaultOpenAIModel,
-		GeminiKey:     "",
-		GeminiModel:   DefaultGeminiModel,
-		SysPromptFile: sysPromptFile,
+		Provider:       DefaultProvider,
+		OllamaURL:      DefaultOllamaURL,
+		OllamaModel:    DefaultOllamaModel,
+		OpenAIKey:      "",
+		OpenAIModel:    DefaultOpenAIModel,
+		GeminiKey:      "",
+		GeminiModel:    DefaultGeminiModel,
+		GeminiURL:      DefaultGeminiURL,
+		AnthropicKey:   "",
+		AnthropicModel: DefaultAnthropicModel,
+		AnthropicURL:   DefaultAnthropicURL,
+		SysPromptFile:  sysPromptFile,
 	}
 
 	// Create directory if it doesn't exist
@@ -262,13 +498,6 @@ func handleCommandError(err error, context string) {
 func cleanLLMResponse(response string) string {
 	response = strings.TrimSpace(response)
 
-	// Remove backticks from start and end (common in markdown code blocks)
-	if strings.HasPrefix(response, "`") && strings.HasSuffix(response, "`") {
-		response = strings.TrimPrefix(response, "`")
-		response = strings.TrimSuffix(response, "`")
-		response = strings.TrimSpace(response)
-	}
-
 	// Handle triple backticks (markdown code blocks)
 	if strings.HasPrefix(response, "```") && strings.HasSuffix(response, "```") {
 		response = strings.TrimPrefix(response, "```")
@@ -280,7 +509,7 @@ func cleanLLMResponse(response string) string {
 		if len(lines) > 0 {
 			// Check if first line is a language identifier
 			firstLine := strings.TrimSpace(lines[0])
-			if firstLine == "bash" || firstLine == "sh" || firstLine == "shell" {
+			if firstLine == "bash" || firstLine == "sh" || firstLine == "shell" || firstLine == "json" {
 				lines = lines[1:]
 				response = strings.Join(lines, "\n")
 				response = strings.TrimSpace(response)
@@ -288,35 +517,88 @@ func cleanLLMResponse(response string) string {
 		}
 	}
 
+	// Remove backticks from start and end (common in markdown code blocks)
+	if strings.HasPrefix(response, "`") && strings.HasSuffix(response, "`") {
+		response = strings.TrimPrefix(response, "`")
+		response = strings.TrimSuffix(response, "`")
+		response = strings.TrimSpace(response)
+	}
+
 	return response
 }
 
+// responseFormatInstructions describes the JSON object every prompt asks for
+const responseFormatInstructions = `Respond with a single JSON object and nothing else, with these fields:
+- "command": the shell command to run
+- "explanation": one short sentence describing what the command does
+- "tools": the programs the command relies on
+- "risk": "low", "medium" or "high" depending on how destructive the command is
+- "assumptions": any assumptions you made about the request, or an empty list
+
+Do not wrap the response in markdown, backticks, or any delimiters.`
+
 // generatePrompt creates a standardized prompt for all LLM providers
-func generatePrompt(naturalLanguage string) string {
+func generatePrompt(request *CommandRequest) *Prompt {
+	return buildPrompt(
+		"Convert the following natural language request into a Unix command appropriate for this operating system. It may refer to earlier requests in this conversation.",
+		withInput(fmt.Sprintf("Natural language request: %s", request.Request), request.Input),
+		request.History,
+	)
+}
+
+// generateRepairPrompt creates a prompt asking the LLM to fix a failed command
+func generateRepairPrompt(repair *RepairRequest) *Prompt {
+	return buildPrompt(
+		"A command generated for the natural language request below failed. Propose a corrected Unix command that achieves the original request on this operating system. Pay attention to differences between GNU and BSD versions of common tools.",
+		withInput(fmt.Sprintf("Natural language request: %s\nFailed command: %s\nExit code: %d\nError output:\n%s", repair.Request, repair.Command, repair.ExitCode, repair.Stderr), repair.Input),
+		repair.History,
+	)
+}
+
+// generateExplainPrompt creates a prompt asking the LLM to explain a command
+// in plain English. Unlike the other prompts it asks for plain text.
+func generateExplainPrompt(explain *ExplainRequest) *Prompt {
+	var b strings.Builder
+	b.WriteString("Explain the following shell command in plain English for someone who has not seen it before.\n\n")
+	b.WriteString(`Start with one sentence summarizing what the whole command does. Then break it down part by part, one line each, in the order they appear: every program in a pipeline or command list, every flag and its argument, and every redirection or shell construct. Format each line as "<part>: <meaning>". Finish with a line starting with "Note:" if the command is destructive, has surprising behavior or differs between GNU and BSD systems.
+
+Respond in plain text only, without markdown formatting.
+
+`)
+	fmt.Fprintf(&b, "Command: %s\n", explain.Command)
+	if explain.Docs != "" {
+		fmt.Fprintf(&b, "\nExcerpts from the local documentation of the programs used, for reference:\n%s\n", explain.Docs)
+	}
+	return userPrompt(fmt.Sprintf("You are a Unix command expert on %s.", detectOS()), b.String())
+}
+
+// withInput appends a description of piped data to prompt details
+func withInput(details string, input *InputSample) string {
+	if input == nil {
+		return details
+	}
+	return details + "\n\n" + input.describe()
+}
+
+// buildPrompt assembles the OS context, custom system prompts and the
+// response format into system instructions that ask for a JSON
+// CommandResponse, followed by any earlier turns and the task details
+func buildPrompt(task string, details string, history *Conversation) *Prompt {
 	osInfo := detectOS()
 
 	// Get system prompts from file
 	config, _ := LoadConfig("")
 	additionalPrompts := handleSysPromptFile(config.SysPromptFile)
 
-	basePrompt := fmt.Sprintf(`You are a Unix command generator for %s. Convert the following natural language request into a Unix command appropriate for this operating system. Only return the command, nothing else. Do not wrap the response in markdown, backticks, or any delimiters.`, osInfo)
-
+	system := fmt.Sprintf("You are a Unix command generator for %s.\n\n%s", osInfo, responseFormatInstructions)
 	if additionalPrompts != "" {
-		return fmt.Sprintf(`%s
-
-Additional instructions: %s
-
-Operating System: %s
-Natural language request: %s
-
-Unix command:`, basePrompt, additionalPrompts, osInfo, naturalLanguage)
+		system = fmt.Sprintf("%s\n\nAdditional instructions: %s", system, additionalPrompts)
 	}
-	return fmt.Sprintf(`%s
-
-Operating System: %s
-Natural language request: %s
 
-Unix command:`, basePrompt, osInfo, naturalLanguage)
+	return &Prompt{
+		System:   system,
+		Messages: history.messages(fmt.Sprintf("%s\n\nOperating System: %s\n%s", task, osInfo, details)),
+	}
 }
 
 // detectOS detects the operating system type and version
@@ -367,202 +649,202 @@ func detectOS() string {
 	}
 }
 
-// CreateLLMClient creates the appropriate LLM client based on configuration
+// CreateLLMClient creates the appropriate LLM client based on configuration.
+// A chain of providers is combined into a FallbackClient.
 func CreateLLMClient(config *Config) (LLMClient, error) {
-	switch strings.ToLower(config.Provider) {
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := config.Providers
+	if len(providers) == 0 {
+		providers = []string{config.Provider}
+	}
+	var clients []LLMClient
+	for _, provider := range providers {
+		client, err := newProviderClient(provider, config, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return NewFallbackClient(clients), nil
+}
+
+// newProviderClient creates the client for a single provider
+func newProviderClient(provider string, config *Config, httpClient *http.Client) (LLMClient, error) {
+	switch strings.ToLower(provider) {
 	case "ollama":
-		return &OllamaClient{URL: config.OllamaURL, Model: config.OllamaModel}, nil
+		return &OllamaClient{URL: config.OllamaURL, Model: config.OllamaModel, HTTPClient: httpClient}, nil
 	case "openai":
 		if config.OpenAIKey == "" {
 			return nil, fmt.Errorf("no OpenAI API key")
 		}
-		return &OpenAIClient{APIKey: config.OpenAIKey, Model: config.OpenAIModel}, nil
+		return newOpenAIClient(config, false, httpClient), nil
+	case "openai_compatible":
+		if config.OpenAIBaseURL == "" {
+			return nil, fmt.Errorf("no base URL for OpenAI-compatible provider (set openai_base_url)")
+		}
+		return newOpenAIClient(config, true, httpClient), nil
 	case "gemini":
 		if config.GeminiKey == "" {
 			return nil, fmt.Errorf("no Gemini API key")
 		}
-		return &GeminiClient{APIKey: config.GeminiKey, Model: config.GeminiModel}, nil
+		url := config.GeminiURL
+		if url == "" {
+			url = DefaultGeminiURL
+		}
+		return &GeminiClient{APIKey: config.GeminiKey, Model: config.GeminiModel, URL: url, HTTPClient: httpClient}, nil
+	case "anthropic":
+		if config.AnthropicKey == "" {
+			return nil, fmt.Errorf("no Anthropic API key")
+		}
+		url := config.AnthropicURL
+		if url == "" {
+			url = DefaultAnthropicURL
+		}
+		model := config.AnthropicModel
+		if model == "" {
+			model = DefaultAnthropicModel
+		}
+		return &AnthropicClient{APIKey: config.AnthropicKey, Model: model, URL: url, HTTPClient: httpClient}, nil
 	default:
-		return nil, fmt.Errorf("unsupported LLM provider: %s", config.Provider)
+		return nil, fmt.Errorf("unsupported LLM provider: %s", provider)
 	}
 }
 
-// shellescape escapes a string for safe use in shell commands
-func shellescape(s string) string {
-	// Simple shell escaping - wrap in single quotes and escape any single quotes
-	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+// newOpenAIClient creates an OpenAIClient from the openai_* configuration fields
+func newOpenAIClient(config *Config, compatible bool, httpClient *http.Client) *OpenAIClient {
+	baseURL := config.OpenAIBaseURL
+	if baseURL == "" {
+		baseURL = DefaultOpenAIBaseURL
+	}
+	return &OpenAIClient{
+		APIKey:       config.OpenAIKey,
+		Model:        config.OpenAIModel,
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		Headers:      config.OpenAIHeaders,
+		Organization: config.OpenAIOrganization,
+		Project:      config.OpenAIProject,
+		AuthScheme:   config.OpenAIAuthScheme,
+		Compatible:   compatible,
+		HTTPClient:   httpClient,
+	}
 }
 
-// SessionState maintains state between command executions
-type SessionState struct {
-	WorkingDir string
-	EnvVars    map[string]string
+// GenerateCommand implements LLMClient for Ollama
+func (c *OllamaClient) GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generatePrompt(request))
 }
 
-// NewSessionState creates a new session state
-func NewSessionState() *SessionState {
-	wd, _ := os.Getwd()
-	return &SessionState{
-		WorkingDir: wd,
-		EnvVars:    make(map[string]string),
-	}
+// RepairCommand implements LLMClient for Ollama
+func (c *OllamaClient) RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generateRepairPrompt(repair))
 }
 
-// ExecuteCommand executes a Unix command with session state persistence
-func ExecuteCommandWithState(state *SessionState, command string) error {
-	if command == "" {
-		return fmt.Errorf("no command generated")
-	}
-
-	if strings.TrimSpace(command) == "" {
-		return fmt.Errorf("empty command")
-	}
+// ExplainCommand implements LLMClient for Ollama
+func (c *OllamaClient) ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error) {
+	return c.complete(ctx, generateExplainPrompt(explain), false)
+}
 
-	// Get the user's current shell from environment variable
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
-	}
+// StreamCommand implements StreamingLLMClient for Ollama
+func (c *OllamaClient) StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generatePrompt(request), onText))
+}
 
-	// Build command that preserves and captures state
-	// First, export all tracked environment variables, then run the command, then capture new state
-	envExports := ""
-	for k, v := range state.EnvVars {
-		envExports += fmt.Sprintf("export %s=%s\n", k, shellescape(v))
-	}
-	
-	stateCommand := fmt.Sprintf(`
-		cd "%s"
-		%s
-		%s
-		echo "UC_STATE_SEPARATOR"
-		pwd
-		echo "UC_ENV_SEPARATOR"
-		env | grep -E '^[A-Za-z_][A-Za-z0-9_]*=' | grep -v '^_' | sort
-	`, state.WorkingDir, envExports, command)
+// StreamRepair implements StreamingLLMClient for Ollama
+func (c *OllamaClient) StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generateRepairPrompt(repair), onText))
+}
 
-	cmd := exec.Command(shell, "-c", stateCommand)
+// generate sends a prompt to Ollama and parses the command response
+func (c *OllamaClient) generate(ctx context.Context, prompt *Prompt) (*CommandResponse, error) {
+	return commandResponse(c.complete(ctx, prompt, true))
+}
 
-	// Set current environment variables
-	cmd.Env = os.Environ()
-	for k, v := range state.EnvVars {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+// newRequest builds an Ollama chat request. If structured is set, the
+// response is constrained to a CommandResponse.
+func (c *OllamaClient) newRequest(ctx context.Context, prompt *Prompt, structured bool, stream bool) (*http.Request, error) {
+	requestBody := ollamaChatRequest{
+		Model:    c.Model,
+		Messages: prompt.chatMessages(),
+		Stream:   stream,
 	}
-
-	// Capture both stdout and stderr
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
-
-	colorCommand.Printf("%s\n", command)
-	os.Stdout.Sync()
-
-	err := cmd.Run()
-
-	// Parse output to separate command output from state info
-	output := stdoutBuf.String()
-	parts := strings.Split(output, "UC_STATE_SEPARATOR")
-
-	if len(parts) >= 2 {
-		// Show command output (everything before the separator)
-		commandOutput := strings.TrimSpace(parts[0])
-		if commandOutput != "" {
-			fmt.Print(commandOutput)
-			if !strings.HasSuffix(commandOutput, "\n") {
-				fmt.Println()
-			}
-		}
-
-		// Parse state information
-		stateParts := strings.Split(parts[1], "UC_ENV_SEPARATOR")
-		if len(stateParts) >= 2 {
-			// Update working directory
-			newWd := strings.TrimSpace(stateParts[0])
-			if newWd != "" {
-				state.WorkingDir = newWd
-			}
-
-			// Update environment variables (simplified)
-			envOutput := strings.TrimSpace(stateParts[1])
-			if envOutput != "" {
-				state.updateEnvVars(envOutput)
-			}
-		}
-	} else {
-		// Fallback: just show all output
-		fmt.Print(output)
+	if structured {
+		requestBody.Format = commandResponseSchema
 	}
 
-	os.Stdout.Sync()
-	os.Stderr.Sync()
-
+	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		if stderrOutput := strings.TrimSpace(stderrBuf.String()); stderrOutput != "" {
-			colorError.Fprintf(os.Stderr, "Error: %s\n", stderrOutput)
-			os.Stderr.Sync()
-		} else {
-			colorError.Fprintf(os.Stderr, "Command failed: %v\n", err)
-			os.Stderr.Sync()
-		}
-		return err
+		return nil, err
 	}
 
-	return nil
-}
-
-// updateEnvVars updates tracked environment variables
-func (s *SessionState) updateEnvVars(envOutput string) {
-	lines := strings.Split(envOutput, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "=") {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				if key != "" && !strings.HasPrefix(key, "_") { // Skip internal vars
-					s.EnvVars[key] = value
-				}
-			}
-		}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
 }
 
-// GenerateCommand implements LLMClient for Ollama
-func (c *OllamaClient) GenerateCommand(naturalLanguage string) (string, error) {
-	prompt := generatePrompt(naturalLanguage)
-
-	requestBody := map[string]interface{}{
-		"model":  c.Model,
-		"prompt": prompt,
-		"stream": false,
-	}
-
-	jsonData, err := json.Marshal(requestBody)
+// complete sends a prompt to Ollama and returns the response text
+func (c *OllamaClient) complete(ctx context.Context, prompt *Prompt, structured bool) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Ollama", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, structured, false)
+	})
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.Post(c.URL+"/api/generate", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to call Ollama API: %v", err)
+	var response ollamaChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("unexpected response format from Ollama: %v", err)
 	}
-	defer resp.Body.Close()
+	if response.Error != "" {
+		return "", &APIError{Provider: "Ollama", Message: response.Error}
+	}
+	return response.Message.Content, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// stream sends a prompt for a structured answer to Ollama and reads the
+// response as it is generated, one JSON object per line
+func (c *OllamaClient) stream(ctx context.Context, prompt *Prompt, onText func(string)) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Ollama", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, true, true)
+	})
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", err
+	var text strings.Builder
+	scanner := newStreamScanner(resp.Body)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return "", fmt.Errorf("unexpected response format from Ollama: %v", err)
+		}
+		if chunk.Error != "" {
+			return "", &APIError{Provider: "Ollama", Message: chunk.Error}
+		}
+		text.WriteString(chunk.Message.Content)
+		onText(chunk.Message.Content)
+		if chunk.Done {
+			break
+		}
 	}
-
-	if responseText, ok := response["response"].(string); ok {
-		return cleanLLMResponse(responseText), nil
+	if err := scanner.Err(); err != nil {
+		return "", err
 	}
-
-	return "", fmt.Errorf("unexpected response format from Ollama")
+	return text.String(), nil
 }
 
 // GetProviderInfo returns provider and model information for Ollama
@@ -571,112 +853,412 @@ func (c *OllamaClient) GetProviderInfo() string {
 }
 
 // GenerateCommand implements LLMClient for OpenAI
-func (c *OpenAIClient) GenerateCommand(naturalLanguage string) (string, error) {
-	prompt := generatePrompt(naturalLanguage)
+func (c *OpenAIClient) GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generatePrompt(request))
+}
+
+// RepairCommand implements LLMClient for OpenAI
+func (c *OpenAIClient) RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generateRepairPrompt(repair))
+}
 
-	requestBody := map[string]interface{}{
-		"model": c.Model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-		"max_tokens": 100,
+// ExplainCommand implements LLMClient for OpenAI
+func (c *OpenAIClient) ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error) {
+	return c.complete(ctx, generateExplainPrompt(explain), false)
+}
+
+// StreamCommand implements StreamingLLMClient for OpenAI
+func (c *OpenAIClient) StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generatePrompt(request), onText))
+}
+
+// StreamRepair implements StreamingLLMClient for OpenAI
+func (c *OpenAIClient) StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generateRepairPrompt(repair), onText))
+}
+
+// GenerateCandidates implements CandidateLLMClient for OpenAI using the n
+// parameter
+func (c *OpenAIClient) GenerateCandidates(ctx context.Context, request *CommandRequest, n int) ([]*CommandResponse, error) {
+	prompt := generatePrompt(request)
+	responses, err := commandResponses(c.completeN(ctx, prompt, true, n))
+	if err != nil {
+		return nil, err
+	}
+	// Many compatible servers ignore n and answer with one choice, so the
+	// rest are sampled
+	for c.Compatible && len(responses) < n {
+		response, err := c.generate(ctx, prompt)
+		if err != nil {
+			break
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// generate sends a prompt to OpenAI and parses the command response
+func (c *OpenAIClient) generate(ctx context.Context, prompt *Prompt) (*CommandResponse, error) {
+	return commandResponse(c.complete(ctx, prompt, true))
+}
+
+// newRequest builds a Chat Completions request for n answers. If structured
+// is set, the response is constrained to a CommandResponse.
+func (c *OpenAIClient) newRequest(ctx context.Context, prompt *Prompt, structured bool, stream bool, n int) (*http.Request, error) {
+	maxTokens := 500
+	if !structured {
+		maxTokens = MaxExplainTokens
+	}
+	requestBody := openAIChatRequest{
+		Model:     c.Model,
+		Messages:  prompt.chatMessages(),
+		MaxTokens: maxTokens,
+		Stream:    stream,
+	}
+	if n > 1 {
+		requestBody.N = n
+	}
+	// Compatible servers vary in structured output support, so they rely on
+	// the prompt and the text fallback instead
+	if structured && !c.Compatible {
+		requestBody.ResponseFormat = &openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: openAIJSONSchema{
+				Name:   "command_response",
+				Strict: true,
+				Schema: commandResponseSchema,
+			},
+		}
 	}
 
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/chat/completions", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	c.setHeaders(req)
+	return req, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// complete sends a prompt to OpenAI and returns the response text
+func (c *OpenAIClient) complete(ctx context.Context, prompt *Prompt, structured bool) (string, error) {
+	texts, err := c.completeN(ctx, prompt, structured, 1)
 	if err != nil {
-		return "", fmt.Errorf("failed to call OpenAI API: %v", err)
+		return "", err
+	}
+	return texts[0], nil
+}
+
+// completeN sends a prompt to OpenAI asking for n alternative answers and
+// returns the text of those that weren't withheld
+func (c *OpenAIClient) completeN(ctx context.Context, prompt *Prompt, structured bool, n int) ([]string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "OpenAI", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, structured, false, n)
+	})
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	var response openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("unexpected response format from OpenAI: %v", err)
+	}
+	if err := response.err(); err != nil {
+		return nil, err
+	}
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("unexpected response format from OpenAI: no choices")
+	}
+
+	var texts []string
+	var withheld error
+	for _, choice := range response.Choices {
+		if err := openAIFinishError(choice.FinishReason, choice.Message.Refusal); err != nil {
+			withheld = err
+			continue
+		}
+		texts = append(texts, choice.Message.Content)
+	}
+	if len(texts) == 0 {
+		return nil, withheld
+	}
+	return texts, nil
+}
+
+// stream sends a prompt for a structured answer to OpenAI and reads the
+// response as it is generated from server-sent events
+func (c *OpenAIClient) stream(ctx context.Context, prompt *Prompt, onText func(string)) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "OpenAI", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, true, true, 1)
+	})
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
+	var text, refusal strings.Builder
+	finishReason := ""
+	err = readSSE(resp.Body, func(data string) error {
+		if data == "[DONE]" {
+			return errStreamDone
+		}
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("unexpected response format from OpenAI: %v", err)
+		}
+		if err := chunk.err(); err != nil {
+			return err
+		}
+		if len(chunk.Choices) > 0 {
+			choice := chunk.Choices[0]
+			text.WriteString(choice.Delta.Content)
+			refusal.WriteString(choice.Delta.Refusal)
+			onText(choice.Delta.Content)
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := openAIFinishError(finishReason, refusal.String()); err != nil {
 		return "", err
 	}
+	return text.String(), nil
+}
 
-	choices, ok := response["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return "", fmt.Errorf("unexpected response format from OpenAI")
+// err returns the error reported in an otherwise successful response, which
+// some compatible servers send instead of an error status
+func (r *openAIChatResponse) err() error {
+	if r.Error == nil {
+		return nil
 	}
+	return &APIError{Provider: "OpenAI", Code: r.Error.Type, Message: r.Error.Message}
+}
 
-	choice := choices[0].(map[string]interface{})
-	message := choice["message"].(map[string]interface{})
-	content := message["content"].(string)
+// openAIFinishError reports answers withheld by the model or a content filter
+func openAIFinishError(finishReason string, refusal string) error {
+	switch {
+	case refusal != "":
+		return &APIError{Provider: "OpenAI", Kind: APIErrorBlocked, Code: "refusal", Message: refusal}
+	case finishReason == "content_filter":
+		return &APIError{Provider: "OpenAI", Kind: APIErrorBlocked, Code: finishReason, Message: "the answer was withheld by the content filter"}
+	}
+	return nil
+}
 
-	return cleanLLMResponse(content), nil
+// setHeaders adds authentication, organization/project and extra headers
+func (c *OpenAIClient) setHeaders(req *http.Request) {
+	if c.APIKey != "" {
+		switch scheme := strings.ToLower(c.AuthScheme); scheme {
+		case "", "bearer":
+			req.Header.Set("Authorization", "Bearer "+c.APIKey)
+		case "api-key":
+			req.Header.Set("api-key", c.APIKey)
+		case "none":
+		default:
+			req.Header.Set("Authorization", c.AuthScheme+" "+c.APIKey)
+		}
+	}
+	if c.Organization != "" {
+		req.Header.Set("OpenAI-Organization", c.Organization)
+	}
+	if c.Project != "" {
+		req.Header.Set("OpenAI-Project", c.Project)
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
 }
 
 // GetProviderInfo returns provider and model information for OpenAI
 func (c *OpenAIClient) GetProviderInfo() string {
+	if c.Compatible {
+		return fmt.Sprintf("OpenAI-compatible (%s @ %s)", c.Model, c.BaseURL)
+	}
 	return fmt.Sprintf("OpenAI (%s)", c.Model)
 }
 
 // GenerateCommand implements LLMClient for Gemini
-func (c *GeminiClient) GenerateCommand(naturalLanguage string) (string, error) {
-	prompt := generatePrompt(naturalLanguage)
-
-	requestBody := map[string]interface{}{
-		"contents": []map[string]interface{}{
-			{
-				"parts": []map[string]string{
-					{"text": prompt},
-				},
-			},
-		},
+func (c *GeminiClient) GenerateCommand(ctx context.Context, request *CommandRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generatePrompt(request))
+}
+
+// RepairCommand implements LLMClient for Gemini
+func (c *GeminiClient) RepairCommand(ctx context.Context, repair *RepairRequest) (*CommandResponse, error) {
+	return c.generate(ctx, generateRepairPrompt(repair))
+}
+
+// ExplainCommand implements LLMClient for Gemini
+func (c *GeminiClient) ExplainCommand(ctx context.Context, explain *ExplainRequest) (string, error) {
+	return c.complete(ctx, generateExplainPrompt(explain), false)
+}
+
+// StreamCommand implements StreamingLLMClient for Gemini
+func (c *GeminiClient) StreamCommand(ctx context.Context, request *CommandRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generatePrompt(request), onText))
+}
+
+// StreamRepair implements StreamingLLMClient for Gemini
+func (c *GeminiClient) StreamRepair(ctx context.Context, repair *RepairRequest, onText func(string)) (*CommandResponse, error) {
+	return commandResponse(c.stream(ctx, generateRepairPrompt(repair), onText))
+}
+
+// GenerateCandidates implements CandidateLLMClient for Gemini using
+// candidateCount
+func (c *GeminiClient) GenerateCandidates(ctx context.Context, request *CommandRequest, n int) ([]*CommandResponse, error) {
+	return commandResponses(c.completeN(ctx, generatePrompt(request), true, n))
+}
+
+// generate sends a prompt to Gemini and parses the command response
+func (c *GeminiClient) generate(ctx context.Context, prompt *Prompt) (*CommandResponse, error) {
+	return commandResponse(c.complete(ctx, prompt, true))
+}
+
+// newRequest builds a request for the Gemini API method, generateContent or
+// streamGenerateContent. If structured is set, the response is constrained
+// to n CommandResponse candidates.
+func (c *GeminiClient) newRequest(ctx context.Context, prompt *Prompt, structured bool, method string, n int) (*http.Request, error) {
+	requestBody := geminiRequest{
+		SystemInstruction: geminiContent{Parts: []geminiPart{{Text: prompt.System}}},
+		Contents:          geminiContents(prompt.Messages),
+	}
+	if structured {
+		requestBody.GenerationConfig = &geminiGenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   geminiResponseSchema,
+		}
+		if n > 1 {
+			requestBody.GenerationConfig.CandidateCount = n
+		}
 	}
 
 	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1beta/models/%s:%s?key=%s", strings.TrimSuffix(c.URL, "/"), c.Model, method, c.APIKey)
+	if method == "streamGenerateContent" {
+		// Stream server-sent events rather than one JSON array
+		url += "&alt=sse"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// complete sends a prompt to Gemini and returns the response text
+func (c *GeminiClient) complete(ctx context.Context, prompt *Prompt, structured bool) (string, error) {
+	texts, err := c.completeN(ctx, prompt, structured, 1)
 	if err != nil {
 		return "", err
 	}
+	return texts[0], nil
+}
 
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", c.Model, c.APIKey)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+// completeN sends a prompt to Gemini asking for n candidate answers and
+// returns the text of those that weren't blocked
+func (c *GeminiClient) completeN(ctx context.Context, prompt *Prompt, structured bool, n int) ([]string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Gemini", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, structured, "generateContent", n)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to call Gemini API: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	var response geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("unexpected response format from Gemini: %v", err)
+	}
+	if len(response.Candidates) == 0 {
+		if err := response.blocked(0); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected response format from Gemini: no candidates")
+	}
+
+	var texts []string
+	var withheld error
+	for i := range response.Candidates {
+		if err := response.blocked(i); err != nil {
+			withheld = err
+			continue
+		}
+		texts = append(texts, response.text(i))
+	}
+	if len(texts) == 0 {
+		return nil, withheld
+	}
+	return texts, nil
+}
+
+// stream sends a prompt for a structured answer to Gemini and reads the
+// response as it is generated from server-sent events
+func (c *GeminiClient) stream(ctx context.Context, prompt *Prompt, onText func(string)) (string, error) {
+	resp, err := sendRequest(ctx, c.HTTPClient, "Gemini", func() (*http.Request, error) {
+		return c.newRequest(ctx, prompt, true, "streamGenerateContent", 1)
+	})
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
+	var text strings.Builder
+	err = readSSE(resp.Body, func(data string) error {
+		var chunk geminiResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("unexpected response format from Gemini: %v", err)
+		}
+		if err := chunk.blocked(0); err != nil {
+			return err
+		}
+		part := chunk.text(0)
+		text.WriteString(part)
+		onText(part)
+		return nil
+	})
+	if err != nil {
 		return "", err
 	}
+	return text.String(), nil
+}
 
-	candidates, ok := response["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		return "", fmt.Errorf("unexpected response format from Gemini")
+// text returns the text of candidate i
+func (r *geminiResponse) text(i int) string {
+	if i >= len(r.Candidates) {
+		return ""
 	}
+	var b strings.Builder
+	for _, part := range r.Candidates[i].Content.Parts {
+		b.WriteString(part.Text)
+	}
+	return b.String()
+}
 
-	candidate := candidates[0].(map[string]interface{})
-	content := candidate["content"].(map[string]interface{})
-	parts := content["parts"].([]interface{})
-	part := parts[0].(map[string]interface{})
-	text := part["text"].(string)
-
-	return cleanLLMResponse(text), nil
+// blocked returns an error if the prompt or candidate i was blocked by
+// Gemini's safety filters
+func (r *geminiResponse) blocked(i int) error {
+	if reason := r.PromptFeedback.BlockReason; reason != "" {
+		return &APIError{Provider: "Gemini", Kind: APIErrorBlocked, Code: reason, Message: "the request was rejected by safety filters"}
+	}
+	if i < len(r.Candidates) && geminiBlockReasons[r.Candidates[i].FinishReason] {
+		return &APIError{Provider: "Gemini", Kind: APIErrorBlocked, Code: r.Candidates[i].FinishReason, Message: "the answer was withheld by safety filters"}
+	}
+	return nil
 }
 
 // GetProviderInfo returns provider and model information for Gemini
@@ -685,44 +1267,237 @@ func (c *GeminiClient) GetProviderInfo() string {
 }
 
 func main() {
+	// Internal mode used by the executor's EXIT trap to capture shell state
+	if len(os.Args) == 3 && os.Args[1] == stateDumpArg {
+		if err := dumpState(os.Args[2]); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Parse command-line flags
 	configPath := flag.String("config", "", "Path to configuration file (default: ~/.uc.json)")
 	dryRun := flag.Bool("n", false, "Dry run: show generated command without executing it")
+	assumeYes := flag.Bool("yes", false, "Run high-risk commands without asking for confirmation")
+	review := flag.Bool("review", false, "Review and edit generated commands before they run")
+	forcePTY := flag.Bool("pty", false, "Run every command on a pseudo-terminal")
+	persistent := flag.Bool("persistent", false, "Run commands in one long-lived shell (default: persistent_shell from config)")
+	requestFile := flag.String("file", "", "Run the requests in a file, one per line (- reads stdin)")
+	stopOnError := flag.Bool("stop-on-error", false, "Stop running requests from a file or stdin after the first one that fails")
+	jsonOutput := flag.Bool("json", false, "Write a JSON report with the command, its exit code and captured output to stdout")
+	printOnly := flag.Bool("print", false, "Print only the generated command to stdout without running it, for use with eval")
+	timeout := flag.Duration("timeout", 0, "Stop commands that run longer than this, e.g. 30s or 5m (default: command_timeout from config)")
+	repair := flag.Int("repair", -1, "Maximum attempts to repair a failed command with the LLM (default: repair_attempts from config)")
+	docs := flag.Bool("docs", true, "Send local man page and --help excerpts along with commands to explain")
+	candidates := flag.Int("candidates", 0, "Ask for this many alternative commands and pick from them (default: candidates from config)")
 	flag.Parse()
 
+	// uc init [shell] prints a keybinding snippet and needs no configuration
+	if args := flag.Args(); len(args) > 0 && args[0] == CmdInit && len(args) <= 2 {
+		shell := ""
+		if len(args) == 2 {
+			shell = args[1]
+		}
+		os.Exit(runInit(shell, *configPath))
+	}
+
+	opts := &RunOptions{DryRun: *dryRun, AssumeYes: *assumeYes, Review: *review, ExplainDocs: *docs}
+	opts.Exec.ForcePTY = *forcePTY
+
+	// uc explain <command> explains a command instead of generating one
+	explain := flag.NArg() > 0 && flag.Arg(0) == CmdExplain
+
+	// Without arguments, piped stdin is read as a list of requests
+	batch := *requestFile != ""
+	if !batch && flag.NArg() == 0 && !isTerminal(os.Stdin) {
+		*requestFile = "-"
+		batch = true
+	}
+
+	var report io.Writer
+	switch {
+	case explain && (*printOnly || *jsonOutput):
+		printError("-print and -json can't be used with explain")
+		os.Exit(ExitUsage)
+	case batch && flag.NArg() > 0:
+		printError("-file can't be combined with a request on the command line")
+		os.Exit(ExitUsage)
+	case batch && (*printOnly || *jsonOutput):
+		printError("-print and -json take a single request, not -file or stdin")
+		os.Exit(ExitUsage)
+	case *printOnly && *jsonOutput:
+		printError("-print and -json can't be used together")
+		os.Exit(ExitUsage)
+	case *printOnly:
+		if flag.NArg() == 0 {
+			printError("-print needs a request, e.g. uc -print \"go to the repo root\"")
+			os.Exit(ExitUsage)
+		}
+		// Only the command is written to stdout so it can be passed to eval
+		opts.PrintTo = redirectOutputToStderr()
+	case *jsonOutput:
+		if flag.NArg() == 0 {
+			printError("-json needs a request, e.g. uc -json \"count the Go files\"")
+			os.Exit(ExitUsage)
+		}
+		report = redirectOutputToStderr()
+	}
+
 	// Load configuration
 	config, err := LoadConfig(*configPath)
 	if err != nil {
 		printError("Error loading configuration: %v", err)
 		fmt.Println("Make sure you have a valid .uc.json configuration file.")
-		os.Exit(1)
+		os.Exit(ExitConfigError)
 	}
 
+	opts.RepairAttempts = config.RepairAttempts
+	opts.Exec.Persistent = config.PersistentShell || *persistent
+	opts.Exec.Timeout = time.Duration(config.CommandTimeout) * time.Second
+	if *timeout > 0 {
+		opts.Exec.Timeout = *timeout
+	}
+	if *repair >= 0 {
+		opts.RepairAttempts = *repair
+	}
+	opts.Candidates = config.Candidates
+	if *candidates > 0 {
+		opts.Candidates = *candidates
+	}
+	opts.Candidates = min(opts.Candidates, MaxCandidates)
+
 	// Create LLM client
 	llmClient, err := CreateLLMClient(config)
 	if err != nil {
 		printError("Error creating LLM client: %v", err)
-		os.Exit(1)
+		os.Exit(ExitConfigError)
+	}
+
+	if explain {
+		os.Exit(runExplain(llmClient, flag.Args()[1:], opts))
+	}
+
+	if opts.Review && !isTerminal(os.Stdin) {
+		printError("-review needs a terminal on stdin")
+		os.Exit(ExitUsage)
+	}
+
+	if batch {
+		requests, err := loadRequests(*requestFile)
+		if err != nil {
+			printError("Error reading requests: %v", err)
+			os.Exit(ExitUsage)
+		}
+		os.Exit(runBatch(llmClient, requests, opts, *stopOnError))
 	}
 
 	// Check if we have command line arguments (non-interactive mode)
 	args := flag.Args()
 	if len(args) >= 1 {
-		// Non-interactive mode: execute single command
-		naturalLanguage := strings.Join(args, " ")
-		fmt.Printf("%s\n", naturalLanguage)
-		state := NewSessionState()
-		processCommand(llmClient, state, naturalLanguage, *dryRun)
-		return
+		// Non-interactive mode: execute single command. Piped stdin is data
+		// for the command, kept for replaying only if it may be repaired.
+		if !isTerminal(os.Stdin) {
+			input, err := readPipedInput(os.Stdin, opts.RepairAttempts > 0)
+			if err != nil {
+				printError("Error reading stdin: %v", err)
+				os.Exit(ExitSystemError)
+			}
+			opts.Exec.Input = input
+		}
+		code := runSingleCommand(llmClient, strings.Join(args, " "), opts, report)
+		if opts.Exec.Input != nil {
+			opts.Exec.Input.Close()
+		}
+		os.Exit(code)
 	}
 
-	// Interactive mode
+	// Interactive mode remembers earlier requests for follow-ups
+	if config.MemoryTokens >= 0 {
+		memoryTokens := config.MemoryTokens
+		if memoryTokens == 0 {
+			memoryTokens = DefaultMemoryTokens
+		}
+		opts.Memory = NewConversation(memoryTokens)
+	}
 	state := NewSessionState()
-	runInteractiveMode(llmClient, state, *dryRun)
+	defer state.Close()
+	runInteractiveMode(llmClient, state, opts)
+}
+
+// runExplain explains the command given as args, or read from piped stdin if
+// there are none, and returns the exit code uc should exit with
+func runExplain(llmClient LLMClient, args []string, opts *RunOptions) int {
+	command := strings.Join(args, " ")
+	if command == "" && !isTerminal(os.Stdin) {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			printError("Error reading stdin: %v", err)
+			return ExitSystemError
+		}
+		command = strings.TrimSpace(string(data))
+	}
+	if command == "" {
+		printError("explain needs a command, e.g. uc explain 'tar -xzvf backup.tar.gz'")
+		return ExitUsage
+	}
+
+	workingDir, _ := os.Getwd()
+	err := explainCommand(llmClient, command, workingDir, opts.ExplainDocs)
+	switch {
+	case errors.Is(err, errGenerationCancelled):
+		colorWarning.Println("Explanation cancelled.")
+		return ExitCancelled
+	case err != nil:
+		handleCommandError(err, "Error explaining command")
+		return ExitGenerationFailed
+	}
+	return ExitOK
+}
+
+// redirectOutputToStderr sends all of uc's own messages to stderr and returns
+// the real stdout, which is then reserved for machine-readable output
+func redirectOutputToStderr() *os.File {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	color.Output = color.Error
+	color.NoColor = os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || !isTerminal(os.Stderr)
+	return stdout
+}
+
+// runSingleCommand processes one natural language request and returns the
+// exit code uc should exit with. If report is set, the command's output is
+// captured and a JSON report is written to it.
+func runSingleCommand(llmClient LLMClient, naturalLanguage string, opts *RunOptions, report io.Writer) int {
+	fmt.Printf("%s\n", naturalLanguage)
+	state := NewSessionState()
+	defer state.Close()
+	if opts.Review {
+		// Reviewing needs a line editor even for a single command
+		rl, err := newReviewReadline(opts)
+		if err != nil {
+			printError("Error initializing readline: %v", err)
+			return ExitSystemError
+		}
+		defer rl.Close()
+	}
+	if report == nil {
+		return processCommand(llmClient, state, naturalLanguage, opts).ExitCode()
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts.Exec.Stdout, opts.Exec.Stderr = &stdout, &stderr
+	start := time.Now()
+	result := processCommand(llmClient, state, naturalLanguage, opts)
+	doc := newJSONReport(naturalLanguage, llmClient.GetProviderInfo(), result, stdout.String(), stderr.String(), time.Since(start), state.WorkingDir)
+	if err := doc.write(report); err != nil {
+		printError("Error writing JSON report: %v", err)
+		return ExitSystemError
+	}
+	return result.ExitCode()
 }
 
 // runInteractiveMode runs the interactive REPL loop
-func runInteractiveMode(llmClient LLMClient, state *SessionState, dryRun bool) {
+func runInteractiveMode(llmClient LLMClient, state *SessionState, opts *RunOptions) {
 	osInfo := detectOS()
 	llmInfo := llmClient.GetProviderInfo()
 
@@ -750,13 +1525,13 @@ func runInteractiveMode(llmClient LLMClient, state *SessionState, dryRun bool) {
 	}
 
 	// Configure readline
-	rl, err := readline.NewEx(&readline.Config{
-		Prompt:          getPrompt(dryRun),
+	rl, err := newPromptReadline(&readline.Config{
+		Prompt:          getPrompt(opts.DryRun),
 		HistoryFile:     historyFile,
 		AutoComplete:    nil,
 		InterruptPrompt: "^C",
 		EOFPrompt:       "exit",
-	})
+	}, opts, func() string { return getPrompt(opts.DryRun) })
 	if err != nil {
 		printError("Error initializing readline: %v", err)
 		return
@@ -800,11 +1575,35 @@ func runInteractiveMode(llmClient LLMClient, state *SessionState, dryRun bool) {
 			continue
 		}
 
+		if strings.ToLower(input) == CmdReset {
+			if opts.Memory == nil {
+				colorWarning.Println("Conversation memory is turned off (memory_tokens is negative).")
+			} else {
+				opts.Memory.Reset()
+				colorSuccess.Println("Conversation memory cleared. New requests won't refer to earlier ones.")
+			}
+			continue
+		}
+
+		// Requests such as "explain the largest files here" are generated
+		// as usual; only a command that can be run is explained
+		if fields := strings.Fields(input); strings.ToLower(fields[0]) == CmdExplain && (len(fields) == 1 || looksLikeCommand(input[len(fields[0]):])) {
+			command := strings.TrimSpace(input[len(fields[0]):])
+			if command == "" {
+				colorWarning.Println("Usage: explain <command>")
+			} else if err := explainCommand(llmClient, command, state.WorkingDir, opts.ExplainDocs); errors.Is(err, errGenerationCancelled) {
+				colorWarning.Println("Explanation cancelled.")
+			} else if err != nil {
+				handleCommandError(err, "Error explaining command")
+			}
+			continue
+		}
+
 		if strings.ToLower(input) == CmdDryRun {
-			dryRun = !dryRun
+			opts.DryRun = !opts.DryRun
 			// Update the prompt color based on dry-run mode
-			rl.SetPrompt(getPrompt(dryRun))
-			if dryRun {
+			rl.SetPrompt(getPrompt(opts.DryRun))
+			if opts.DryRun {
 				colorWarning.Println("Dry-run mode enabled. Commands will be shown but not executed.")
 			} else {
 				colorSuccess.Println("Dry-run mode disabled. Commands will be executed normally.")
@@ -812,45 +1611,483 @@ func runInteractiveMode(llmClient LLMClient, state *SessionState, dryRun bool) {
 			continue
 		}
 
+		if strings.ToLower(input) == CmdReview {
+			opts.Review = !opts.Review
+			if opts.Review {
+				colorSuccess.Println("Review mode enabled. Commands can be edited before they run.")
+			} else {
+				colorWarning.Println("Review mode disabled. Commands will run as generated.")
+			}
+			continue
+		}
+
+		if strings.ToLower(input) == CmdPTY {
+			opts.Exec.ForcePTY = !opts.Exec.ForcePTY
+			if opts.Exec.ForcePTY {
+				colorSuccess.Println("PTY mode enabled. All commands will run on a pseudo-terminal.")
+			} else {
+				colorWarning.Println("PTY mode disabled. Only interactive programs will run on a pseudo-terminal.")
+			}
+			continue
+		}
+
 		// Process the command
-		processCommand(llmClient, state, input, dryRun)
+		processCommand(llmClient, state, input, opts)
 		fmt.Println() // Add blank line for readability
 	}
 }
 
+// newReviewReadline creates the line editor used for review and confirmation
+// prompts outside the interactive REPL. It writes to os.Stdout as it is now
+// rather than readline's default, the stdout uc started with, so that with
+// -print or -json the prompts go to stderr like every other message.
+func newReviewReadline(opts *RunOptions) (*readline.Instance, error) {
+	return newPromptReadline(&readline.Config{Prompt: NormalPrompt, Stdout: os.Stdout}, opts, func() string { return NormalPrompt })
+}
+
+// newPromptReadline creates a readline instance and wires the confirmation
+// and review prompts and the candidate menu in opts to it. prompt returns
+// the prompt to restore after asking a question.
+func newPromptReadline(cfg *readline.Config, opts *RunOptions, prompt func() string) (*readline.Instance, error) {
+	var reviewing, regenerate atomic.Bool
+
+	// Ctrl-G submits the review line and asks for a new command instead
+	cfg.FuncFilterInputRune = func(r rune) (rune, bool) {
+		if r == readline.CharBell && reviewing.Load() {
+			regenerate.Store(true)
+			return readline.CharEnter, true
+		}
+		return r, true
+	}
+
+	rl, err := readline.NewEx(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// High-risk commands are confirmed through the same readline instance
+	opts.Confirm = func(question string) bool {
+		rl.SetPrompt(colorWarning.Sprint(question + " [y/N] "))
+		rl.HistoryDisable()
+		defer func() {
+			rl.HistoryEnable()
+			rl.SetPrompt(prompt())
+		}()
+		answer, err := rl.Readline()
+		if err != nil {
+			return false
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+
+	// Candidate commands are picked by number from the menu
+	opts.Choose = func(count int) (int, bool) {
+		rl.SetPrompt(colorInfo.Sprintf("Choose a command [1-%d, Enter for 1]: ", count))
+		rl.HistoryDisable()
+		defer func() {
+			rl.HistoryEnable()
+			rl.SetPrompt(prompt())
+		}()
+		for {
+			answer, err := rl.Readline()
+			if err != nil {
+				return 0, false
+			}
+			answer = strings.TrimSpace(answer)
+			if answer == "" {
+				return 0, true
+			}
+			if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= count {
+				return n - 1, true
+			}
+			colorWarning.Printf("Enter a number from 1 to %d, or press Ctrl-C to cancel\n", count)
+		}
+	}
+
+	// Generated commands are pre-filled into the buffer for editing
+	opts.Edit = func(command string) (string, reviewAction) {
+		colorInfo.Println("Enter to run, Ctrl-G to regenerate, Ctrl-C to cancel")
+		rl.SetPrompt(colorCommand.Sprint(ReviewPrompt))
+		rl.HistoryDisable()
+		reviewing.Store(true)
+		regenerate.Store(false)
+		defer func() {
+			reviewing.Store(false)
+			rl.HistoryEnable()
+			rl.SetPrompt(prompt())
+		}()
+
+		edited, err := rl.ReadlineWithDefault(command)
+		if regenerate.Load() {
+			return "", reviewRegenerate
+		}
+		edited = strings.TrimSpace(edited)
+		if err != nil || edited == "" {
+			return "", reviewCancel
+		}
+		return edited, reviewRun
+	}
+
+	return rl, nil
+}
+
+// reviewAction is the user's decision after reviewing a generated command
+type reviewAction int
+
+const (
+	reviewRun reviewAction = iota
+	reviewRegenerate
+	reviewCancel
+)
+
+// RunOptions controls how generated commands are handled before execution
+type RunOptions struct {
+	DryRun         bool
+	AssumeYes      bool
+	Review         bool
+	RepairAttempts int
+	Exec           ExecOptions
+	// ExplainDocs sends local documentation along with commands to explain
+	ExplainDocs bool
+	// Memory, if set, holds earlier requests that are sent with each new one
+	// and records how each request turned out
+	Memory *Conversation
+	// PrintTo, if set, receives the raw command instead of running it
+	PrintTo io.Writer
+	// Confirm asks the user a yes/no question; nil means uc is not interactive
+	Confirm func(question string) bool
+	// Edit lets the user edit, regenerate or cancel a generated command
+	Edit func(command string) (string, reviewAction)
+	// Candidates is how many alternative commands to ask for per request
+	Candidates int
+	// Choose asks the user to pick one of count numbered candidates and
+	// returns its index, or false to cancel; nil means the best ranked
+	// candidate is used
+	Choose func(count int) (int, bool)
+}
+
+// CommandStatus describes how processing a request ended
+type CommandStatus int
+
+const (
+	StatusSucceeded CommandStatus = iota
+	StatusDryRun
+	StatusPrinted
+	StatusGenerationFailed
+	StatusRefused
+	StatusCancelled
+	StatusFailed
+)
+
+// String returns the status name used in JSON reports
+func (s CommandStatus) String() string {
+	switch s {
+	case StatusSucceeded:
+		return "succeeded"
+	case StatusDryRun:
+		return "dry_run"
+	case StatusPrinted:
+		return "printed"
+	case StatusGenerationFailed:
+		return "generation_failed"
+	case StatusRefused:
+		return "refused"
+	case StatusCancelled:
+		return "cancelled"
+	default:
+		return "failed"
+	}
+}
+
+// CommandResult is the outcome of processing a natural language request
+type CommandResult struct {
+	Status CommandStatus
+	// Command is the last command that was run or proposed
+	Command string
+	// Explanation is the LLM's explanation of Command, if any
+	Explanation string
+	// Err is the generation error, or the execution error (usually a
+	// *CommandError) when Status is StatusFailed
+	Err error
+}
+
+// ExitCode maps the result to uc's exit status in single-command mode
+func (r *CommandResult) ExitCode() int {
+	switch r.Status {
+	case StatusSucceeded, StatusDryRun, StatusPrinted:
+		return ExitOK
+	case StatusGenerationFailed:
+		return ExitGenerationFailed
+	case StatusRefused:
+		return ExitRefused
+	case StatusCancelled:
+		return ExitCancelled
+	}
+
+	var cmdErr *CommandError
+	if !errors.As(r.Err, &cmdErr) {
+		return ExitSystemError
+	}
+	switch {
+	case cmdErr.TimedOut:
+		return ExitTimeout
+	case cmdErr.Interrupted:
+		return ExitCancelled
+	case cmdErr.Signal != 0:
+		return ExitSignalBase + int(cmdErr.Signal)
+	case cmdErr.ExitCode > 0:
+		return cmdErr.ExitCode
+	default:
+		return ExitSystemError
+	}
+}
+
+// executionResult builds the result of running the command in response
+func executionResult(response *CommandResponse, err error) *CommandResult {
+	result := &CommandResult{Status: StatusSucceeded, Command: response.Command, Explanation: response.Explanation}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Err = err
+	}
+	return result
+}
+
 // processCommand processes a single natural language command
-func processCommand(llmClient LLMClient, state *SessionState, naturalLanguage string, dryRun bool) {
-	// Create and start spinner while generating command
-	s := createSpinner("Generating command...")
-	s.Start()
+func processCommand(llmClient LLMClient, state *SessionState, naturalLanguage string, opts *RunOptions) (result *CommandResult) {
+	execOpts := opts.Exec
+	var output *syncTailBuffer
+	if opts.Memory != nil {
+		// Leave room for escape sequences that are stripped when recording
+		output = &syncTailBuffer{tailBuffer: tailBuffer{max: 2 * MaxMemoryOutput}}
+		execOpts.Transcript = output
+		defer func() {
+			opts.Memory.Record(naturalLanguage, result, output.String())
+		}()
+	}
+
+	request := &CommandRequest{Request: naturalLanguage, History: opts.Memory}
+	if opts.Exec.Input != nil {
+		request.Input = opts.Exec.Input.Sample
+	}
+	message := "Generating command..."
+	if opts.Candidates > 1 {
+		message = fmt.Sprintf("Generating %d candidate commands...", opts.Candidates)
+	}
+	response, result := prepareCommand(state, opts, message, func(ctx context.Context, onText func(string)) ([]*CommandResponse, error) {
+		if opts.Candidates > 1 {
+			return generateCandidates(ctx, llmClient, request, opts.Candidates)
+		}
+		if streamer, ok := llmClient.(StreamingLLMClient); ok {
+			return single(streamer.StreamCommand(ctx, request, onText))
+		}
+		return single(llmClient.GenerateCommand(ctx, request))
+	})
+	if result != nil {
+		return result
+	}
+
+	// Execute the generated command
+	err := ExecuteCommandWithState(state, response.Command, execOpts)
 
-	// Generate Unix command using LLM
-	unixCommand, err := llmClient.GenerateCommand(naturalLanguage)
+	// Optionally send failures back to the LLM for a corrected command
+	for attempt := 1; err != nil && attempt <= opts.RepairAttempts; attempt++ {
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Interrupted {
+			break
+		}
+		handleCommandError(err, "Error executing command")
+		if opts.Confirm != nil && !opts.Confirm(fmt.Sprintf("Ask the LLM to repair the command? (attempt %d of %d)", attempt, opts.RepairAttempts)) {
+			return executionResult(response, err)
+		}
 
-	// Stop spinner
-	s.Stop()
+		repair := &RepairRequest{
+			Request:  naturalLanguage,
+			Command:  cmdErr.Command,
+			ExitCode: cmdErr.ExitCode,
+			Stderr:   truncateTail(cmdErr.Stderr, MaxRepairStderr),
+			Input:    request.Input,
+			History:  opts.Memory,
+		}
+		repaired, result := prepareCommand(state, opts, "Repairing command...", func(ctx context.Context, onText func(string)) ([]*CommandResponse, error) {
+			if streamer, ok := llmClient.(StreamingLLMClient); ok {
+				return single(streamer.StreamRepair(ctx, repair, onText))
+			}
+			return single(llmClient.RepairCommand(ctx, repair))
+		})
+		if result != nil {
+			// The original failure is what the caller needs to know about
+			return executionResult(response, err)
+		}
+		response = repaired
+		if output != nil {
+			output.Reset()
+		}
+		// Captured output, as for -json, describes the command that ran last
+		for _, w := range []io.Writer{execOpts.Stdout, execOpts.Stderr} {
+			if buf, ok := w.(interface{ Reset() }); ok {
+				buf.Reset()
+			}
+		}
+		err = ExecuteCommandWithState(state, response.Command, execOpts)
+	}
 
 	if err != nil {
-		handleCommandError(err, "Error generating command")
-		return
+		handleCommandError(err, "Error executing command")
 	}
+	return executionResult(response, err)
+}
 
-	if strings.TrimSpace(unixCommand) == "" {
-		printError("LLM returned empty command")
-		return
+// prepareCommand asks the LLM for a command using generate, lets the user
+// pick one if there are several candidates and review it, and applies the
+// risk checks. It returns the response with Command set to the command to
+// run, or a non-nil result describing why the command should not be
+// executed.
+func prepareCommand(state *SessionState, opts *RunOptions, message string, generate generateFunc) (*CommandResponse, *CommandResult) {
+	var response *CommandResponse
+	var unixCommand string
+	for {
+		// Generate Unix command using LLM, showing it as it streams in
+		responses, err := generateWithPreview(message, generate)
+
+		if errors.Is(err, errGenerationCancelled) {
+			colorWarning.Println("Generation cancelled.")
+			return nil, &CommandResult{Status: StatusCancelled, Err: err}
+		}
+		if err != nil {
+			handleCommandError(err, "Error generating command")
+			return nil, &CommandResult{Status: StatusGenerationFailed, Err: err}
+		}
+
+		response = responses[0]
+		chosen := false
+		if candidates := rankCandidates(responses, state.WorkingDir); len(responses) > 1 && len(candidates) > 0 {
+			choice := 0
+			if opts.Choose != nil && len(candidates) > 1 {
+				showCandidates(candidates)
+				var ok bool
+				if choice, ok = opts.Choose(len(candidates)); !ok {
+					colorWarning.Println("Command cancelled.")
+					return nil, &CommandResult{Status: StatusCancelled}
+				}
+				chosen = true
+			}
+			response = candidates[choice].Response
+		}
+
+		unixCommand = response.Command
+		if strings.TrimSpace(unixCommand) == "" {
+			printError("LLM returned empty command")
+			return nil, &CommandResult{Status: StatusGenerationFailed, Err: fmt.Errorf("LLM returned empty command")}
+		}
+
+		// The menu already showed the explanation of a chosen candidate
+		if !chosen {
+			showExplanation(response)
+		}
+
+		if !opts.Review || opts.DryRun || opts.Edit == nil {
+			break
+		}
+
+		// Let the user edit the command; the edited version is what runs
+		edited, action := opts.Edit(unixCommand)
+		if action == reviewRegenerate {
+			continue
+		}
+		if action == reviewCancel {
+			colorWarning.Println("Command cancelled.")
+			return nil, &CommandResult{Status: StatusCancelled, Command: unixCommand, Explanation: response.Explanation}
+		}
+		unixCommand = edited
+		break
+	}
+
+	response.Command = unixCommand
+	risk := AnalyzeRisk(unixCommand, state.WorkingDir)
+	if level := response.RiskLevel(); level > risk.Level {
+		risk.raise(level, "model assessed risk as "+level.String())
 	}
+	showRisk(risk)
 
-	if dryRun {
+	if opts.DryRun {
 		// Dry run: just show the command without executing
 		colorWarning.Print("[dry run] ")
 		colorCommand.Printf("%s\n", unixCommand)
+		return nil, &CommandResult{Status: StatusDryRun, Command: unixCommand, Explanation: response.Explanation}
+	}
+
+	if status := confirmRisk(risk, unixCommand, opts); status != StatusSucceeded {
+		return nil, &CommandResult{Status: status, Command: unixCommand, Explanation: response.Explanation}
+	}
+
+	if opts.PrintTo != nil {
+		// The risk checks still apply since the caller will run the command
+		fmt.Fprintln(opts.PrintTo, unixCommand)
+		return nil, &CommandResult{Status: StatusPrinted, Command: unixCommand, Explanation: response.Explanation}
+	}
+
+	return response, nil
+}
+
+// truncateTail keeps at most max bytes from the end of s
+func truncateTail(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return "..." + s[len(s)-max:]
+}
+
+// showExplanation prints the model's explanation, assumptions and any tools
+// it relies on that are missing from PATH
+func showExplanation(response *CommandResponse) {
+	if response.Explanation != "" {
+		colorInfo.Print("Explanation: ")
+		fmt.Println(response.Explanation)
+	}
+	for _, assumption := range response.Assumptions {
+		colorInfo.Print("Assumption: ")
+		fmt.Println(assumption)
+	}
+	if missing := response.MissingTools(); len(missing) > 0 {
+		colorWarning.Fprintf(os.Stderr, "Warning: not found on PATH: %s\n", strings.Join(missing, ", "))
+	}
+}
+
+// showRisk prints the risk level and reasons for medium and high risk commands
+func showRisk(risk RiskAssessment) {
+	showRiskIndented(risk, "")
+}
+
+// showRiskIndented prints what showRisk does after indent, as in a list
+func showRiskIndented(risk RiskAssessment, indent string) {
+	if risk.Level == RiskLow {
 		return
 	}
+	c := colorWarning
+	if risk.Level == RiskHigh {
+		c = colorError
+	}
+	c.Fprintf(os.Stderr, "%sRisk: %s (%s)\n", indent, risk.Level, strings.Join(risk.Reasons, "; "))
+}
 
-	// Execute the generated command
-	if err := ExecuteCommandWithState(state, unixCommand); err != nil {
-		handleCommandError(err, "Error executing command")
+// confirmRisk decides whether a command may run given its risk level. It
+// returns StatusSucceeded if it may, StatusRefused if the risk policy blocks
+// it and StatusCancelled if the user declined.
+func confirmRisk(risk RiskAssessment, command string, opts *RunOptions) CommandStatus {
+	if risk.Level < RiskHigh || opts.AssumeYes {
+		return StatusSucceeded
+	}
+	if opts.Confirm == nil {
+		printError("Refusing to run high-risk command without confirmation. Re-run with --yes to execute it.")
+		return StatusRefused
+	}
+	colorCommand.Printf("%s\n", command)
+	if !opts.Confirm("Execute this high-risk command?") {
+		colorWarning.Println("Command cancelled.")
+		return StatusCancelled
 	}
+	return StatusSucceeded
 }
 
 // showHelp displays help information
@@ -864,6 +2101,15 @@ func showHelp() {
 	fmt.Println(" - Show this help message")
 	colorSuccess.Printf("  %-12s", CmdDryRun)
 	fmt.Println(" - Toggle dry-run mode (show commands without executing)")
+	colorSuccess.Printf("  %-12s", CmdReview)
+	fmt.Println(" - Toggle review mode (edit generated commands before they run)")
+	colorSuccess.Printf("  %-12s", CmdPTY)
+	fmt.Println(" - Toggle running every command on a pseudo-terminal")
+	colorSuccess.Printf("  %-12s", CmdReset)
+	fmt.Println(" - Forget earlier requests so new ones start a fresh conversation")
+	colorSuccess.Printf("  %-12s", CmdExplain+" CMD")
+	fmt.Println(" - Explain what an existing shell command does; other requests starting")
+	fmt.Println("                 with \"explain\", such as \"explain the disk usage\", run as usual")
 	colorSuccess.Printf("  %-12s", CmdExit)
 	fmt.Println(" - Exit the program")
 	fmt.Println()
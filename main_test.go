@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testPrompt is a prompt that doesn't need the config, unlike buildPrompt
+var testPrompt = &Prompt{System: "system", Messages: []ChatMessage{{Role: "user", Content: "list files"}}}
+
+// providerTest is a response body and what the client should make of it
+type providerTest struct {
+	name string
+	body string
+	want string
+	// err is the expected error text, if any
+	err string
+	// blocked is set if the error must be an APIErrorBlocked
+	blocked bool
+}
+
+// runProviderTests serves each body in turn and checks the result of
+// complete, which must not panic however the body is shaped
+func runProviderTests(t *testing.T, tests []providerTest, complete func(url string) (string, error)) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.RawQuery, "alt=sse") {
+					w.Header().Set("Content-Type", "text/event-stream")
+				}
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			got, err := complete(server.URL)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("text = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.err)
+			}
+			var apiErr *APIError
+			if isBlocked := errors.As(err, &apiErr) && apiErr.Kind == APIErrorBlocked; isBlocked != tt.blocked {
+				t.Errorf("error %v blocked = %t, want %t", err, isBlocked, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestOpenAIResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: `{"choices":[{"message":{"content":"ls -la"},"finish_reason":"stop"}]}`, want: "ls -la"},
+		{name: "no choices", body: `{"choices":[]}`, err: "no choices"},
+		{name: "empty object", body: `{}`, err: "no choices"},
+		{name: "choice without a message", body: `{"choices":[{}]}`, want: ""},
+		{name: "error in a 200 response", body: `{"error":{"message":"model overloaded","type":"server_error"}}`, err: "OpenAI API error (server_error): model overloaded"},
+		{name: "refusal", body: `{"choices":[{"message":{"refusal":"I can't help with that"}}]}`, err: "I can't help with that", blocked: true},
+		{name: "content filter", body: `{"choices":[{"message":{"content":""},"finish_reason":"content_filter"}]}`, err: "content filter", blocked: true},
+		{name: "not JSON", body: `<html>gateway</html>`, err: "unexpected response format from OpenAI"},
+		{name: "choices of the wrong type", body: `{"choices":{"message":"ls"}}`, err: "unexpected response format from OpenAI"},
+	}, func(url string) (string, error) {
+		client := &OpenAIClient{APIKey: "key", Model: "model", BaseURL: url, HTTPClient: http.DefaultClient}
+		return client.complete(context.Background(), testPrompt, true)
+	})
+}
+
+func TestOpenAIStreamResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: "data: {\"choices\":[{\"delta\":{\"content\":\"ls\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\" -la\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n", want: "ls -la"},
+		{name: "chunk without choices", body: "data: {\"choices\":[]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"ls\"}}]}\n\ndata: [DONE]\n\n", want: "ls"},
+		{name: "error event", body: "data: {\"error\":{\"message\":\"overloaded\",\"type\":\"server_error\"}}\n\n", err: "overloaded"},
+		{name: "refusal", body: "data: {\"choices\":[{\"delta\":{\"refusal\":\"no\"}}]}\n\ndata: [DONE]\n\n", err: "no", blocked: true},
+	}, func(url string) (string, error) {
+		client := &OpenAIClient{APIKey: "key", Model: "model", BaseURL: url, HTTPClient: http.DefaultClient}
+		return client.stream(context.Background(), testPrompt, func(string) {})
+	})
+}
+
+func TestGeminiResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: `{"candidates":[{"content":{"parts":[{"text":"ls "},{"text":"-la"}]},"finishReason":"STOP"}]}`, want: "ls -la"},
+		{name: "no candidates", body: `{}`, err: "no candidates"},
+		{name: "candidate without content", body: `{"candidates":[{"finishReason":"STOP"}]}`, want: ""},
+		{name: "blocked prompt", body: `{"promptFeedback":{"blockReason":"SAFETY"}}`, err: "rejected by safety filters", blocked: true},
+		{name: "withheld answer", body: `{"candidates":[{"finishReason":"SAFETY"}]}`, err: "withheld by safety filters", blocked: true},
+		{name: "parts of the wrong type", body: `{"candidates":[{"content":{"parts":"ls"}}]}`, err: "unexpected response format from Gemini"},
+	}, func(url string) (string, error) {
+		client := &GeminiClient{APIKey: "key", Model: "model", URL: url, HTTPClient: http.DefaultClient}
+		return client.complete(context.Background(), testPrompt, true)
+	})
+}
+
+func TestGeminiStreamResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"ls\"}]}}]}\n\ndata: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\" -la\"}]},\"finishReason\":\"STOP\"}]}\n\n", want: "ls -la"},
+		{name: "event without candidates", body: "data: {}\n\ndata: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"ls\"}]}}]}\n\n", want: "ls"},
+		{name: "withheld answer", body: "data: {\"candidates\":[{\"finishReason\":\"RECITATION\"}]}\n\n", err: "withheld", blocked: true},
+	}, func(url string) (string, error) {
+		client := &GeminiClient{APIKey: "key", Model: "model", URL: url, HTTPClient: http.DefaultClient}
+		return client.stream(context.Background(), testPrompt, func(string) {})
+	})
+}
+
+func TestOllamaResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: `{"message":{"role":"assistant","content":"ls -la"},"done":true}`, want: "ls -la"},
+		{name: "empty object", body: `{}`, want: ""},
+		{name: "error in a 200 response", body: `{"error":"model requires more system memory"}`, err: "Ollama API error: model requires more system memory"},
+		{name: "message of the wrong type", body: `{"message":"ls"}`, err: "unexpected response format from Ollama"},
+	}, func(url string) (string, error) {
+		client := &OllamaClient{URL: url, Model: "model", HTTPClient: http.DefaultClient}
+		return client.complete(context.Background(), testPrompt, true)
+	})
+}
+
+func TestOllamaStreamResponses(t *testing.T) {
+	runProviderTests(t, []providerTest{
+		{name: "answer", body: "{\"message\":{\"content\":\"ls\"}}\n\n{\"message\":{\"content\":\" -la\"},\"done\":true}\n", want: "ls -la"},
+		{name: "error line", body: "{\"message\":{\"content\":\"ls\"}}\n{\"error\":\"out of memory\"}\n", err: "out of memory"},
+	}, func(url string) (string, error) {
+		client := &OllamaClient{URL: url, Model: "model", HTTPClient: http.DefaultClient}
+		return client.stream(context.Background(), testPrompt, func(string) {})
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Conversation memory limits
+const (
+	// DefaultMemoryTokens is the default token budget for earlier turns
+	DefaultMemoryTokens = 2000
+	// MaxMemoryOutput limits how much of a command's output is remembered
+	MaxMemoryOutput = 1000
+	// bytesPerToken is a rough average used to estimate token counts
+	bytesPerToken = 4
+)
+
+// Chat message roles
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// ansiEscape matches terminal escape sequences such as colors
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[()][0-9A-Za-z])`)
+
+// ChatMessage is one message of a conversation with the LLM
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Prompt is what is sent to the LLM: system instructions followed by a
+// conversation that ends with the latest user message
+type Prompt struct {
+	System   string
+	Messages []ChatMessage
+}
+
+// userPrompt returns a prompt made of a single user message
+func userPrompt(system string, content string) *Prompt {
+	return &Prompt{System: system, Messages: []ChatMessage{{Role: RoleUser, Content: content}}}
+}
+
+// chatMessages returns the prompt as a list of role and content messages,
+// starting with the system instructions, as used by OpenAI and Ollama
+func (p *Prompt) chatMessages() []ChatMessage {
+	return append([]ChatMessage{{Role: "system", Content: p.System}}, p.Messages...)
+}
+
+// geminiContents converts chat messages to Gemini contents, where the
+// assistant's role is called model
+func geminiContents(messages []ChatMessage) []geminiContent {
+	var contents []geminiContent
+	for _, msg := range messages {
+		role := msg.Role
+		if role == RoleAssistant {
+			role = "model"
+		}
+		contents = append(contents, geminiContent{Role: role, Parts: []geminiPart{{Text: msg.Content}}})
+	}
+	return contents
+}
+
+// Turn is an earlier request in the session and what came of it
+type Turn struct {
+	Request     string
+	Command     string
+	Explanation string
+	Status      CommandStatus
+	Err         error
+	// Output holds the end of the command's output, if it ran
+	Output string
+}
+
+// reply returns the turn's command as the LLM would have answered it
+func (t *Turn) reply() string {
+	data, _ := json.Marshal(map[string]string{"command": t.Command, "explanation": t.Explanation})
+	return string(data)
+}
+
+// outcome describes what happened to the turn's command
+func (t *Turn) outcome() string {
+	var outcome string
+	switch t.Status {
+	case StatusSucceeded:
+		outcome = "The previous command succeeded (exit code 0)."
+	case StatusFailed:
+		outcome = fmt.Sprintf("The previous command failed: %v.", t.Err)
+	case StatusDryRun:
+		return "The previous command was shown to the user but not run (dry run)."
+	case StatusPrinted:
+		return "The previous command was printed for the user to run."
+	case StatusRefused:
+		return "The previous command was not run because it is high risk."
+	case StatusCancelled:
+		return "The user cancelled the previous command without running it."
+	default:
+		return ""
+	}
+	if t.Output == "" {
+		return outcome + " It printed nothing."
+	}
+	return fmt.Sprintf("%s Its output ended with:\n%s", outcome, t.Output)
+}
+
+// tokens estimates how many tokens the turn adds to a prompt
+func (t *Turn) tokens() int {
+	return (len(t.Request) + len(t.reply()) + len(t.outcome())) / bytesPerToken
+}
+
+// Conversation is a bounded history of turns sent along with each request so
+// that follow-ups such as "sort that by size" can refer to earlier ones
+type Conversation struct {
+	// MaxTokens is the budget for earlier turns; the oldest turns are
+	// dropped once it is exceeded
+	MaxTokens int
+	turns     []*Turn
+}
+
+// NewConversation returns an empty conversation with the given token budget
+func NewConversation(maxTokens int) *Conversation {
+	return &Conversation{MaxTokens: maxTokens}
+}
+
+// Record adds the outcome of a request to the conversation. Requests that
+// produced no command are not remembered.
+func (c *Conversation) Record(request string, result *CommandResult, output string) {
+	if result.Command == "" {
+		return
+	}
+	c.turns = append(c.turns, &Turn{
+		Request:     request,
+		Command:     result.Command,
+		Explanation: result.Explanation,
+		Status:      result.Status,
+		Err:         result.Err,
+		Output:      cleanOutput(output, MaxMemoryOutput),
+	})
+
+	total := 0
+	for _, turn := range c.turns {
+		total += turn.tokens()
+	}
+	for len(c.turns) > 0 && total > c.MaxTokens {
+		total -= c.turns[0].tokens()
+		c.turns = c.turns[1:]
+	}
+}
+
+// Reset forgets all earlier turns
+func (c *Conversation) Reset() {
+	c.turns = nil
+}
+
+// messages returns the conversation as chat messages followed by latest.
+// The outcome of each turn's command opens the next user message, so the
+// roles alternate as every provider requires. A nil conversation has no
+// earlier turns.
+func (c *Conversation) messages(latest string) []ChatMessage {
+	var msgs []ChatMessage
+	previous := ""
+	for _, turn := range c.remembered() {
+		msgs = append(msgs,
+			ChatMessage{Role: RoleUser, Content: joinNonEmpty(previous, "Natural language request: "+turn.Request)},
+			ChatMessage{Role: RoleAssistant, Content: turn.reply()},
+		)
+		previous = turn.outcome()
+	}
+	return append(msgs, ChatMessage{Role: RoleUser, Content: joinNonEmpty(previous, latest)})
+}
+
+// remembered returns the turns, or none for a nil conversation
+func (c *Conversation) remembered() []*Turn {
+	if c == nil {
+		return nil
+	}
+	return c.turns
+}
+
+// joinNonEmpty joins the non-empty parts with blank lines
+func joinNonEmpty(parts ...string) string {
+	var kept []string
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "\n\n")
+}
+
+// cleanOutput strips terminal escapes and carriage returns from output and
+// keeps at most max bytes of whole lines from its end
+func cleanOutput(output string, max int) string {
+	output = ansiEscape.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, "\r", "")
+	output = strings.TrimSpace(strings.ToValidUTF8(output, ""))
+	if len(output) <= max {
+		return output
+	}
+	output = output[len(output)-max:]
+	if i := strings.IndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	return "...\n" + strings.ToValidUTF8(output, "")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// succeeded returns the result of a command that ran and succeeded
+func succeeded(command string) *CommandResult {
+	return &CommandResult{Status: StatusSucceeded, Command: command, Explanation: "runs " + command}
+}
+
+// rememberedRequests returns the requests of the turns c remembers
+func rememberedRequests(c *Conversation) []string {
+	var requests []string
+	for _, turn := range c.remembered() {
+		requests = append(requests, turn.Request)
+	}
+	return requests
+}
+
+func TestConversationRecord(t *testing.T) {
+	// Every turn recorded by the test is the same size
+	turnTokens := (&Turn{Request: "request 1", Command: "echo 1", Explanation: "runs echo 1", Status: StatusSucceeded}).tokens()
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		turns     int
+		// output is recorded as the output of the last turn
+		output string
+		want   []string
+	}{
+		{
+			name:      "within the budget",
+			maxTokens: 3 * turnTokens,
+			turns:     3,
+			want:      []string{"request 1", "request 2", "request 3"},
+		},
+		{
+			name:      "oldest turns dropped",
+			maxTokens: 2*turnTokens + 1,
+			turns:     5,
+			want:      []string{"request 4", "request 5"},
+		},
+		{
+			name:      "turn larger than the budget",
+			maxTokens: 3 * turnTokens,
+			turns:     2,
+			output:    strings.Repeat("x", MaxMemoryOutput),
+			want:      nil,
+		},
+		{
+			name:      "no budget",
+			maxTokens: 0,
+			turns:     2,
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConversation(tt.maxTokens)
+			for i := 1; i <= tt.turns; i++ {
+				output := ""
+				if i == tt.turns {
+					output = tt.output
+				}
+				c.Record(fmt.Sprintf("request %d", i), succeeded(fmt.Sprintf("echo %d", i)), output)
+			}
+			if got := rememberedRequests(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("remembered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConversationRecordWithoutCommand(t *testing.T) {
+	c := NewConversation(DefaultMemoryTokens)
+	c.Record("do something impossible", &CommandResult{Status: StatusFailed, Err: errors.New("no command")}, "")
+	if got := rememberedRequests(c); got != nil {
+		t.Errorf("remembered %q, want nothing", got)
+	}
+}
+
+func TestConversationMessages(t *testing.T) {
+	c := NewConversation(DefaultMemoryTokens)
+	c.Record("list files", succeeded("ls"), "a.txt\nb.txt\n")
+	c.Record("remove a.txt", &CommandResult{Status: StatusFailed, Command: "rm a.txt", Err: errors.New("exit status 1")}, "")
+	c.Record("show b.txt", &CommandResult{Status: StatusDryRun, Command: "cat b.txt"}, "")
+
+	msgs := c.messages("latest request")
+	if len(msgs) != 7 {
+		t.Fatalf("got %d messages, want 7: %+v", len(msgs), msgs)
+	}
+	for i, msg := range msgs {
+		want := RoleUser
+		if i%2 == 1 {
+			want = RoleAssistant
+		}
+		if msg.Role != want {
+			t.Errorf("message %d role = %q, want %q", i, msg.Role, want)
+		}
+	}
+
+	wantContents := []string{
+		"Natural language request: list files",
+		`{"command":"ls","explanation":"runs ls"}`,
+		"The previous command succeeded (exit code 0). Its output ended with:\na.txt\nb.txt\n\nNatural language request: remove a.txt",
+		`{"command":"rm a.txt","explanation":""}`,
+		"The previous command failed: exit status 1. It printed nothing.\n\nNatural language request: show b.txt",
+		`{"command":"cat b.txt","explanation":""}`,
+		"The previous command was shown to the user but not run (dry run).\n\nlatest request",
+	}
+	for i, want := range wantContents {
+		if msgs[i].Content != want {
+			t.Errorf("message %d = %q, want %q", i, msgs[i].Content, want)
+		}
+	}
+
+	c.Reset()
+	if got := c.messages("fresh start"); !reflect.DeepEqual(got, []ChatMessage{{Role: RoleUser, Content: "fresh start"}}) {
+		t.Errorf("messages after Reset = %+v, want only the latest request", got)
+	}
+}
+
+func TestNilConversation(t *testing.T) {
+	var c *Conversation
+	if got := c.messages("list files"); !reflect.DeepEqual(got, []ChatMessage{{Role: RoleUser, Content: "list files"}}) {
+		t.Errorf("messages of a nil conversation = %+v, want only the latest request", got)
+	}
+}
+
+func TestCleanOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		max    int
+		want   string
+	}{
+		{"plain", "hello\n", 100, "hello"},
+		{"colors", "\x1b[1;32mok\x1b[0m done\n", 100, "ok done"},
+		{"title and charset escapes", "\x1b]0;title\x07\x1b(Bline\n", 100, "line"},
+		{"carriage returns", "line 1\r\nline 2\r\n", 100, "line 1\nline 2"},
+		{"progress overwritten with carriage returns", "10%\r50%\r100%\n", 100, "10%50%100%"},
+		{"invalid UTF-8", "caf\xe9\n", 100, "caf"},
+		{"kept whole lines from the end", "first line\nsecond line\nthird line\n", 15, "...\nthird line"},
+		{"line longer than the limit", "a very long line without breaks", 10, "...\nout breaks"},
+		{"multi-byte character cut", "ééééé", 5, "...\néé"},
+	}
+	for _, tt := range tests {
+		if got := cleanOutput(tt.output, tt.max); got != tt.want {
+			t.Errorf("cleanOutput(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
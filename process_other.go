@@ -0,0 +1,33 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is a no-op on platforms without process groups
+func setProcessGroup(cmd *exec.Cmd, foreground bool) {}
+
+// signalProcessGroup signals only the process itself on this platform
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// setForeground is a no-op on platforms without job control
+func setForeground(pgid int) {}
+
+// restoreForeground is a no-op on platforms without job control
+func restoreForeground() {}
+
+// foregroundGroup always returns 0 on platforms without job control
+func foregroundGroup() int { return 0 }
+
+// ownGroup always returns 0 on platforms without process groups
+func ownGroup() int { return 0 }
@@ -0,0 +1,58 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setProcessGroup starts cmd in its own process group so it can be signalled
+// as a whole. If foreground is set the group is also made the terminal's
+// foreground group, so Ctrl-C and terminal reads reach the command rather
+// than uc.
+func setProcessGroup(cmd *exec.Cmd, foreground bool) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if foreground {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+	}
+}
+
+// signalProcessGroup sends sig to every process in the group led by pid
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
+
+// setForeground makes pgid the foreground process group of the terminal on
+// stdin. SIGTTOU is ignored while doing so, since uc may itself be in the
+// background at that point.
+func setForeground(pgid int) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	unix.IoctlSetPointerInt(int(os.Stdin.Fd()), unix.TIOCSPGRP, pgid)
+}
+
+// restoreForeground hands the terminal back to uc's own process group
+func restoreForeground() {
+	setForeground(ownGroup())
+}
+
+// foregroundGroup returns the foreground process group of the terminal on
+// stdin, or 0 if there is none
+func foregroundGroup() int {
+	pgid, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return 0
+	}
+	return pgid
+}
+
+// ownGroup returns uc's own process group
+func ownGroup() int {
+	return unix.Getpgrp()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Requests that read and change the termios settings of a terminal
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
+
+// openPTY allocates a pseudo-terminal pair through /dev/ptmx
+func openPTY() (ptmx *os.File, tty *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := ptmx.Fd()
+
+	// grantpt, unlockpt and ptsname
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, unix.TIOCPTYGRANT, 0); errno != 0 {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("grantpt: %v", errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, unix.TIOCPTYUNLK, 0); errno != 0 {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("unlockpt: %v", errno)
+	}
+	name := make([]byte, 128)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, unix.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0]))); errno != 0 {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("ptsname: %v", errno)
+	}
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	tty, err = os.OpenFile(string(name), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
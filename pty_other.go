@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// errPTYUnsupported is returned on platforms without pty support
+var errPTYUnsupported = errors.New("pseudo-terminals are not supported on this platform")
+
+// openPTY is not supported on this platform
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, errPTYUnsupported
+}
+
+// runOnPTY is not supported on this platform
+func runOnPTY(cmd *exec.Cmd, ptmx *os.File, tty *os.File) error {
+	return errPTYUnsupported
+}
+
+// mirrorOutput is not supported on this platform
+func mirrorOutput(copies io.Writer) (*os.File, func(), error) {
+	return nil, nil, errPTYUnsupported
+}
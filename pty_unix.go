@@ -0,0 +1,180 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ptyDrainTimeout bounds how long output is drained after the command exits,
+// in case a background process keeps the terminal open
+const ptyDrainTimeout = 500 * time.Millisecond
+
+// runOnPTY runs cmd with the pseudo-terminal tty as its controlling terminal,
+// relaying the user's terminal to ptmx in raw mode until the command exits
+func runOnPTY(cmd *exec.Cmd, ptmx *os.File, tty *os.File) error {
+	defer ptmx.Close()
+
+	stdinFd := int(os.Stdin.Fd())
+	syncWinsize(stdinFd, ptmx)
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err := cmd.Start()
+	tty.Close()
+	if err != nil {
+		return err
+	}
+
+	// Propagate terminal resizes to the child
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			syncWinsize(stdinFd, ptmx)
+		}
+	}()
+	defer func() {
+		signal.Stop(winch)
+		close(winch)
+	}()
+
+	// Raw mode lets keys like Ctrl-C reach the child's line discipline
+	if oldState, err := term.MakeRaw(stdinFd); err == nil {
+		defer term.Restore(stdinFd, oldState)
+	}
+
+	stopInput := pumpStdin(stdinFd, ptmx)
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, ptmx)
+		close(outputDone)
+	}()
+
+	err = cmd.Wait()
+	stopInput()
+	select {
+	case <-outputDone:
+	case <-time.After(ptyDrainTimeout):
+	}
+	return err
+}
+
+// mirrorOutput returns a pseudo-terminal for a command to use as its stdout.
+// Everything written to it is copied to the user's stdout and to copies, so
+// the output can be recorded while the command still sees a terminal. wait
+// must be called after the command exits to drain the output and release
+// the pseudo-terminal.
+func mirrorOutput(copies io.Writer) (tty *os.File, wait func(), err error) {
+	ptmx, tty, err := openPTY()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The user's terminal already translates newlines, so the mirror passes
+	// output through unchanged instead of turning "\n" into "\r\n" twice
+	if termios, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlGetTermios); err == nil {
+		termios.Oflag &^= unix.ONLCR
+		unix.IoctlSetTermios(int(tty.Fd()), ioctlSetTermios, termios)
+	}
+
+	// Propagate terminal resizes so full-width output still fits
+	stdoutFd := int(os.Stdout.Fd())
+	syncWinsize(stdoutFd, ptmx)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			syncWinsize(stdoutFd, ptmx)
+		}
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(io.MultiWriter(os.Stdout, copies), ptmx)
+		close(outputDone)
+	}()
+
+	return tty, func() {
+		signal.Stop(winch)
+		close(winch)
+		tty.Close()
+		select {
+		case <-outputDone:
+		case <-time.After(ptyDrainTimeout):
+		}
+		ptmx.Close()
+	}, nil
+}
+
+// syncWinsize copies the window size of the user's terminal to the pty
+func syncWinsize(fd int, ptmx *os.File) {
+	if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+		withFd(ptmx, func(ptmxFd int) {
+			unix.IoctlSetWinsize(ptmxFd, unix.TIOCSWINSZ, ws)
+		})
+	}
+}
+
+// withFd runs fn with the descriptor of f without switching f to blocking
+// mode the way f.Fd() does, so closing f still interrupts pending reads
+func withFd(f *os.File, fn func(fd int)) {
+	if rc, err := f.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			fn(int(fd))
+		})
+	}
+}
+
+// pumpStdin copies stdin to w until the returned stop function is called.
+// It polls rather than blocking in read so that no keystroke meant for the
+// next readline prompt is consumed after the command exits.
+func pumpStdin(fd int, w io.Writer) (stop func()) {
+	cancelR, cancelW, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		fds := []unix.PollFd{
+			{Fd: int32(fd), Events: unix.POLLIN},
+			{Fd: int32(cancelR.Fd()), Events: unix.POLLIN},
+		}
+		buf := make([]byte, 1024)
+		for {
+			if _, err := unix.Poll(fds, -1); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				return
+			}
+			if fds[1].Revents != 0 {
+				return
+			}
+			if fds[0].Revents != 0 {
+				n, err := unix.Read(fd, buf)
+				if n <= 0 || err != nil {
+					return
+				}
+				w.Write(buf[:n])
+			}
+		}
+	}()
+
+	return func() {
+		cancelW.Write([]byte{0})
+		<-done
+		cancelR.Close()
+		cancelW.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// JSONReport is the document written in JSON output mode
+type JSONReport struct {
+	Input       string `json:"input"`
+	Provider    string `json:"provider"`
+	Command     string `json:"command"`
+	Explanation string `json:"explanation,omitempty"`
+	Status      string `json:"status"`
+	ExitCode    int    `json:"exit_code"`
+	Stdout      string `json:"stdout"`
+	Stderr      string `json:"stderr"`
+	DurationMs  int64  `json:"duration_ms"`
+	WorkingDir  string `json:"working_dir"`
+	Error       string `json:"error,omitempty"`
+}
+
+// newJSONReport describes a processed request and the output its command
+// produced
+func newJSONReport(input string, provider string, result *CommandResult, stdout string, stderr string, duration time.Duration, workingDir string) *JSONReport {
+	report := &JSONReport{
+		Input:       input,
+		Provider:    provider,
+		Command:     result.Command,
+		Explanation: result.Explanation,
+		Status:      result.Status.String(),
+		ExitCode:    result.ExitCode(),
+		Stdout:      stdout,
+		Stderr:      stderr,
+		DurationMs:  duration.Milliseconds(),
+		WorkingDir:  workingDir,
+	}
+	if result.Err != nil {
+		report.Error = result.Err.Error()
+	}
+	return report
+}
+
+// write encodes the report as a single JSON document
+func (r *JSONReport) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
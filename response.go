@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CommandResponse is the structured answer requested from the LLM
+type CommandResponse struct {
+	Command     string   `json:"command"`
+	Explanation string   `json:"explanation"`
+	Tools       []string `json:"tools"`
+	Risk        string   `json:"risk"`
+	Assumptions []string `json:"assumptions"`
+}
+
+// commandResponseSchema is the JSON schema for CommandResponse, used with
+// the native structured output modes of OpenAI, Ollama and Anthropic
+var commandResponseSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"command":     map[string]interface{}{"type": "string"},
+		"explanation": map[string]interface{}{"type": "string"},
+		"tools":       map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"risk":        map[string]interface{}{"type": "string", "enum": []string{"low", "medium", "high"}},
+		"assumptions": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+	},
+	"required":             []string{"command", "explanation", "tools", "risk", "assumptions"},
+	"additionalProperties": false,
+}
+
+// geminiResponseSchema is commandResponseSchema in Gemini's OpenAPI subset
+var geminiResponseSchema = map[string]interface{}{
+	"type": "OBJECT",
+	"properties": map[string]interface{}{
+		"command":     map[string]interface{}{"type": "STRING"},
+		"explanation": map[string]interface{}{"type": "STRING"},
+		"tools":       map[string]interface{}{"type": "ARRAY", "items": map[string]interface{}{"type": "STRING"}},
+		"risk":        map[string]interface{}{"type": "STRING", "enum": []string{"low", "medium", "high"}},
+		"assumptions": map[string]interface{}{"type": "ARRAY", "items": map[string]interface{}{"type": "STRING"}},
+	},
+	"required": []string{"command", "explanation", "tools", "risk", "assumptions"},
+}
+
+// parseCommandResponse parses the LLM's JSON answer, falling back to
+// treating the whole response as the command when it is not a JSON answer.
+// A JSON answer without a usable command, such as a refusal, is an error
+// rather than something to run.
+func parseCommandResponse(text string) (*CommandResponse, error) {
+	cleaned := cleanLLMResponse(text)
+
+	if fields, ok := leadingJSONObject(cleaned); ok && isAnswer(fields) {
+		return decodeCommandResponse(fields)
+	}
+
+	return &CommandResponse{Command: cleaned}, nil
+}
+
+// leadingJSONObject decodes the JSON object the response starts with, inside
+// a code fence or not, ignoring any prose after it. JSON further into the
+// response belongs to a plain-text command, such as the body of curl -d.
+func leadingJSONObject(response string) (map[string]json.RawMessage, bool) {
+	if rest, ok := strings.CutPrefix(response, "```"); ok {
+		// Skip the language identifier and stop at the closing fence
+		if _, body, ok := strings.Cut(rest, "\n"); ok {
+			response, _, _ = strings.Cut(body, "```")
+		}
+		response = strings.TrimSpace(response)
+	}
+	if !strings.HasPrefix(response, "{") {
+		return nil, false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(strings.NewReader(response)).Decode(&fields); err != nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// isAnswer reports whether a JSON object has any of the fields of a
+// CommandResponse, as opposed to being part of a plain-text command such as
+// find's {} or an awk program
+func isAnswer(fields map[string]json.RawMessage) bool {
+	for _, key := range []string{"command", "explanation", "tools", "risk", "assumptions"} {
+		if _, ok := fields[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeCommandResponse decodes the fields of a JSON answer. The command
+// must be a non-empty string; the other fields are optional and taken
+// leniently, so a single tool given as a string still counts.
+func decodeCommandResponse(fields map[string]json.RawMessage) (*CommandResponse, error) {
+	response := &CommandResponse{
+		Explanation: jsonString(fields["explanation"]),
+		Tools:       jsonStrings(fields["tools"]),
+		Risk:        jsonString(fields["risk"]),
+		Assumptions: jsonStrings(fields["assumptions"]),
+	}
+	if err := json.Unmarshal(fields["command"], &response.Command); err != nil {
+		return nil, fmt.Errorf("LLM answer has no command string")
+	}
+	if strings.TrimSpace(response.Command) == "" {
+		if explanation := strings.TrimSpace(response.Explanation); explanation != "" {
+			return nil, fmt.Errorf("LLM returned no command: %s", explanation)
+		}
+		return nil, fmt.Errorf("LLM returned an empty command")
+	}
+	return response.normalize(), nil
+}
+
+// jsonString decodes a JSON string, or returns "" for anything else
+func jsonString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// jsonStrings decodes a JSON array of strings, accepting a lone string as a
+// list of one and skipping items that aren't strings
+func jsonStrings(raw json.RawMessage) []string {
+	if s := jsonString(raw); s != "" {
+		return []string{s}
+	}
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		return nil
+	}
+	var values []string
+	for _, item := range items {
+		if s := jsonString(item); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// normalize trims fields and drops values that don't match the contract
+func (r *CommandResponse) normalize() *CommandResponse {
+	r.Command = cleanLLMResponse(r.Command)
+	r.Explanation = strings.TrimSpace(r.Explanation)
+	r.Risk = strings.ToLower(strings.TrimSpace(r.Risk))
+	if r.Risk != "low" && r.Risk != "medium" && r.Risk != "high" {
+		r.Risk = ""
+	}
+	r.Tools = nonEmpty(r.Tools)
+	r.Assumptions = nonEmpty(r.Assumptions)
+	return r
+}
+
+// RiskLevel converts the model's self-assessed risk to a RiskLevel
+func (r *CommandResponse) RiskLevel() RiskLevel {
+	switch r.Risk {
+	case "high":
+		return RiskHigh
+	case "medium":
+		return RiskMedium
+	default:
+		return RiskLow
+	}
+}
+
+// MissingTools returns the tools the command relies on that are not on PATH
+func (r *CommandResponse) MissingTools() []string {
+	var missing []string
+	for _, tool := range r.Tools {
+		if strings.ContainsAny(tool, " /") {
+			continue
+		}
+		if _, err := exec.LookPath(tool); err != nil && !isShellBuiltin(tool) {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
+
+// shellBuiltins are the builtins and reserved words of common shells
+var shellBuiltins = map[string]bool{
+	"cd": true, "export": true, "unset": true, "set": true, "alias": true, "unalias": true,
+	"source": true, ".": true, "eval": true, "exec": true, "exit": true, "return": true,
+	"shift": true, "local": true, "declare": true, "typeset": true, "readonly": true,
+	"trap": true, "wait": true, "jobs": true, "fg": true, "bg": true, "umask": true,
+	"ulimit": true, "type": true, "history": true, "echo": true, "printf": true, "read": true,
+	"if": true, "then": true, "else": true, "fi": true, "for": true, "while": true,
+	"do": true, "done": true, "case": true, "esac": true, "{": true, "}": true,
+}
+
+// isShellBuiltin reports whether name is run by the shell itself rather than
+// looked up on PATH
+func isShellBuiltin(name string) bool {
+	return shellBuiltins[name]
+}
+
+// nonEmpty trims each string and drops empty ones
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    *CommandResponse
+		wantErr bool
+	}{
+		{
+			name: "structured answer",
+			text: `{"command":"ls -la","explanation":"lists files","tools":["ls"],"risk":"Low","assumptions":[]}`,
+			want: &CommandResponse{Command: "ls -la", Explanation: "lists files", Tools: []string{"ls"}, Risk: "low"},
+		},
+		{
+			name: "answer in a code fence",
+			text: "```json\n{\"command\":\"pwd\"}\n```",
+			want: &CommandResponse{Command: "pwd"},
+		},
+		{
+			name: "tools given as a string",
+			text: `{"command":"ls","tools":"ls"}`,
+			want: &CommandResponse{Command: "ls", Tools: []string{"ls"}},
+		},
+		{
+			name: "wrongly typed optional fields",
+			text: `{"command":"ls","tools":[1,"grep"],"risk":3,"assumptions":{"a":1}}`,
+			want: &CommandResponse{Command: "ls", Tools: []string{"grep"}},
+		},
+		{
+			name: "plain-text command",
+			text: "ls -la",
+			want: &CommandResponse{Command: "ls -la"},
+		},
+		{
+			name: "plain-text command with braces",
+			text: `find . -name '*.tmp' -exec rm {} \;`,
+			want: &CommandResponse{Command: `find . -name '*.tmp' -exec rm {} \;`},
+		},
+		{
+			name: "plain-text awk program",
+			text: `awk '{print $1}' file.txt`,
+			want: &CommandResponse{Command: `awk '{print $1}' file.txt`},
+		},
+		{
+			name: "answer followed by prose",
+			text: "{\"command\":\"df -h\"}\nThis shows free disk space.",
+			want: &CommandResponse{Command: "df -h"},
+		},
+		{
+			name: "answer in a code fence followed by prose",
+			text: "```json\n{\"command\":\"df -h\"}\n```\nThis shows free disk space.",
+			want: &CommandResponse{Command: "df -h"},
+		},
+		{
+			name: "plain-text curl with a JSON body",
+			text: `curl -X POST -d '{"command": "reboot"}' http://localhost:8080/api`,
+			want: &CommandResponse{Command: `curl -X POST -d '{"command": "reboot"}' http://localhost:8080/api`},
+		},
+		{
+			name: "plain-text curl with an answer-like JSON body",
+			text: `curl -d '{"explanation":"x"}' http://localhost:8080/api`,
+			want: &CommandResponse{Command: `curl -d '{"explanation":"x"}' http://localhost:8080/api`},
+		},
+		{
+			name: "plain-text jq filter",
+			text: `echo '{"command":"ls","risk":"low"}' | jq -r .command`,
+			want: &CommandResponse{Command: `echo '{"command":"ls","risk":"low"}' | jq -r .command`},
+		},
+		{
+			name: "plain-text docker format template",
+			text: `docker inspect -f '{{.State.Status}}' web`,
+			want: &CommandResponse{Command: `docker inspect -f '{{.State.Status}}' web`},
+		},
+		{
+			name: "plain-text brace group",
+			text: `{ date; uptime; } > status.txt`,
+			want: &CommandResponse{Command: `{ date; uptime; } > status.txt`},
+		},
+		{name: "refusal", text: `{"command":"","explanation":"I can't do that"}`, wantErr: true},
+		{name: "missing command", text: `{"explanation":"lists files","tools":["ls"]}`, wantErr: true},
+		{name: "command not a string", text: `{"command":["ls"],"explanation":"lists files"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommandResponse(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCommandResponse(%q) = %+v, want an error", tt.text, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCommandResponse(%q) failed: %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCommandResponse(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
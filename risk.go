@@ -0,0 +1,791 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RiskLevel classifies how dangerous a generated command is
+type RiskLevel int
+
+const (
+	RiskLow RiskLevel = iota
+	RiskMedium
+	RiskHigh
+)
+
+// String returns the lowercase name of the risk level
+func (r RiskLevel) String() string {
+	switch r {
+	case RiskHigh:
+		return "high"
+	case RiskMedium:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// RiskAssessment is the result of statically analyzing a shell command
+type RiskAssessment struct {
+	Level   RiskLevel
+	Reasons []string
+}
+
+// raise bumps the assessment to at least the given level and records why
+func (a *RiskAssessment) raise(level RiskLevel, reason string) {
+	if level > a.Level {
+		a.Level = level
+	}
+	for _, r := range a.Reasons {
+		if r == reason {
+			return
+		}
+	}
+	a.Reasons = append(a.Reasons, reason)
+}
+
+// shellToken is a word or operator produced by tokenizeShell
+type shellToken struct {
+	text string
+	op   bool
+}
+
+// simpleCommand is a single command within a pipeline or list
+type simpleCommand struct {
+	args      []string
+	redirects []redirect
+	pipedFrom *simpleCommand
+}
+
+// redirect is an output or input redirection attached to a command
+type redirect struct {
+	op     string
+	target string
+}
+
+// Commands that are dangerous no matter how they are invoked
+var highRiskCommands = map[string]string{
+	"dd":       "raw disk copy with dd",
+	"mkfs":     "creates a filesystem",
+	"mkswap":   "formats a swap area",
+	"fdisk":    "modifies partition tables",
+	"sfdisk":   "modifies partition tables",
+	"parted":   "modifies partition tables",
+	"wipefs":   "wipes filesystem signatures",
+	"shred":    "irrecoverably overwrites files",
+	"shutdown": "shuts down the system",
+	"reboot":   "reboots the system",
+	"halt":     "halts the system",
+	"poweroff": "powers off the system",
+}
+
+// Commands that modify or discard data and deserve a warning
+var mediumRiskCommands = map[string]string{
+	"rmdir":    "removes directories",
+	"truncate": "truncates files",
+	"kill":     "terminates processes",
+	"killall":  "terminates processes",
+	"pkill":    "terminates processes",
+	"eval":     "evaluates dynamically built code",
+	"crontab":  "modifies scheduled jobs",
+}
+
+// Commands that write to the last path argument
+var writingCommands = map[string]bool{
+	"cp": true, "mv": true, "ln": true, "install": true,
+	"touch": true, "mkdir": true, "tee": true, "rsync": true,
+}
+
+// Commands that download content from the network
+var downloadCommands = map[string]bool{
+	"curl": true, "wget": true, "fetch": true,
+}
+
+// Interpreters that execute whatever is fed to them on stdin
+var shellInterpreters = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true,
+	"python": true, "python3": true, "perl": true, "ruby": true, "node": true,
+}
+
+// Flags that give an interpreter its code on the command line; shells not
+// listed here use -c
+var inlineCodeFlags = map[string]string{
+	"python": "cm", "python3": "cm", "perl": "eE", "ruby": "e", "node": "ep",
+}
+
+// Interpreter options that take the next argument as their value
+var interpreterValueFlags = map[string]bool{
+	"-o": true, "+o": true, "-O": true, "+O": true, "-W": true, "-X": true,
+	"--rcfile": true, "--init-file": true,
+}
+
+// Prefixes under which writes affect the operating system itself
+var systemPaths = []string{"/etc", "/usr", "/bin", "/sbin", "/lib", "/boot", "/sys", "/proc", "/var", "/dev", "/System", "/Library"}
+
+// Device files that are always safe to write to
+var harmlessDevices = map[string]bool{
+	"/dev/null": true, "/dev/stdout": true, "/dev/stderr": true, "/dev/tty": true,
+}
+
+// AnalyzeRisk statically inspects a shell command and classifies its risk
+func AnalyzeRisk(command string, workingDir string) RiskAssessment {
+	var assessment RiskAssessment
+
+	compact := strings.Join(strings.Fields(command), "")
+	if strings.Contains(compact, ":(){") && strings.Contains(compact, ":|:") {
+		assessment.raise(RiskHigh, "fork bomb")
+	}
+
+	for _, cmd := range parseCommandLine(command) {
+		analyzeSimpleCommand(cmd, workingDir, &assessment, 0)
+	}
+
+	return assessment
+}
+
+// analyzeSimpleCommand applies the risk rules to one command of a pipeline
+func analyzeSimpleCommand(cmd *simpleCommand, workingDir string, a *RiskAssessment, depth int) {
+	for _, r := range cmd.redirects {
+		analyzeRedirect(r, workingDir, a)
+	}
+
+	args := stripCommandPrefixes(cmd.args, a)
+	if len(args) == 0 {
+		return
+	}
+	name := filepath.Base(args[0])
+
+	if cmd.pipedFrom != nil && shellInterpreters[name] && readsStdin(name, args[1:]) {
+		reason := "pipes data into " + name + " for execution"
+		level := RiskMedium
+		for src := cmd.pipedFrom; src != nil; src = src.pipedFrom {
+			if isDownload(src.args) {
+				reason, level = "pipes downloaded content into "+name, RiskHigh
+				break
+			}
+		}
+		a.raise(level, reason)
+	}
+
+	// Downloaded code can also reach an interpreter or eval through a command
+	// or process substitution, as in bash <(curl ...) or eval "$(curl ...)"
+	if shellInterpreters[name] || name == "eval" || name == "source" || name == "." {
+		code := args[1:]
+		for _, r := range cmd.redirects {
+			if r.op == "<" {
+				code = append(code, r.target)
+			}
+		}
+		for _, arg := range code {
+			if substitutesDownload(arg) {
+				a.raise(RiskHigh, "runs downloaded content with "+name)
+			}
+		}
+	}
+
+	if reason, ok := highRiskCommands[name]; ok {
+		a.raise(RiskHigh, reason)
+	} else if strings.HasPrefix(name, "mkfs.") {
+		a.raise(RiskHigh, highRiskCommands["mkfs"])
+	} else if reason, ok := mediumRiskCommands[name]; ok {
+		a.raise(RiskMedium, reason)
+	}
+
+	switch name {
+	case "rm":
+		targets, flags := splitFlags(args[1:])
+		if hasFlag(flags, "r", "R", "recursive") {
+			a.raise(RiskHigh, "recursively deletes files")
+		} else {
+			a.raise(RiskMedium, "deletes files")
+		}
+		for _, t := range targets {
+			if isCriticalPath(t, workingDir) {
+				a.raise(RiskHigh, "deletes "+t)
+			}
+			checkWriteTarget(t, workingDir, a)
+		}
+	case "chmod", "chown", "chgrp":
+		targets, flags := splitFlags(args[1:])
+		if hasFlag(flags, "R", "recursive") {
+			a.raise(RiskHigh, "recursively changes ownership or permissions")
+		} else {
+			a.raise(RiskMedium, "changes ownership or permissions")
+		}
+		for _, t := range targets {
+			checkWriteTarget(t, workingDir, a)
+		}
+	case "find":
+		for i, arg := range args {
+			if arg == "-delete" {
+				a.raise(RiskHigh, "find deletes matching files")
+			}
+			if (arg == "-exec" || arg == "-execdir" || arg == "-ok") && i+1 < len(args) {
+				sub := &simpleCommand{args: findExecArgs(args[i+1:])}
+				analyzeSimpleCommand(sub, workingDir, a, depth+1)
+			}
+		}
+	case "xargs":
+		if sub := xargsCommand(args[1:]); len(sub) > 0 {
+			analyzeSimpleCommand(&simpleCommand{args: sub}, workingDir, a, depth+1)
+		}
+	case "git":
+		analyzeGit(args[1:], a)
+	case "sh", "bash", "zsh", "dash", "ksh":
+		for i, arg := range args {
+			if arg == "-c" && i+1 < len(args) && depth < 3 {
+				for _, sub := range parseCommandLine(args[i+1]) {
+					analyzeSimpleCommand(sub, workingDir, a, depth+1)
+				}
+			}
+		}
+	}
+
+	if writingCommands[name] {
+		targets, _ := splitFlags(args[1:])
+		if len(targets) > 0 {
+			if name == "tee" || name == "touch" || name == "mkdir" {
+				for _, t := range targets {
+					checkWriteTarget(t, workingDir, a)
+				}
+			} else if dest := targets[len(targets)-1]; strings.HasPrefix(resolvePath(dest, workingDir), "/dev/") {
+				// Unlike a redirect, this replaces even /dev/null
+				a.raise(RiskHigh, "moves or copies onto device "+resolvePath(dest, workingDir))
+			} else {
+				checkWriteTarget(dest, workingDir, a)
+			}
+		}
+	}
+}
+
+// readsStdin reports whether an interpreter given args runs the code fed to
+// it on stdin: it has no script operand, or is told to read the script from
+// stdin with - or a shell's -s
+func readsStdin(name string, args []string) bool {
+	codeFlags, ok := inlineCodeFlags[name]
+	if !ok {
+		codeFlags = "c"
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-":
+			return true
+		case arg == "--":
+			return i+1 == len(args) || args[i+1] == "-"
+		case interpreterValueFlags[arg]:
+			i++
+		case strings.HasPrefix(arg, "--"):
+			continue
+		case len(arg) > 1 && (arg[0] == '-' || arg[0] == '+'):
+			if strings.ContainsAny(arg[1:], codeFlags) {
+				return false
+			}
+			if _, ok := inlineCodeFlags[name]; !ok && strings.Contains(arg[1:], "s") {
+				return true
+			}
+		default:
+			// A script operand, so stdin is only data
+			return false
+		}
+	}
+	return true
+}
+
+// isDownload reports whether args run a command that downloads content
+func isDownload(args []string) bool {
+	args = stripCommandPrefixes(args, &RiskAssessment{})
+	return len(args) > 0 && downloadCommands[filepath.Base(args[0])]
+}
+
+// substitutesDownload reports whether a word contains a command or process
+// substitution that downloads content
+func substitutesDownload(word string) bool {
+	for _, sub := range commandSubstitutions(word) {
+		for _, cmd := range parseCommandLine(sub) {
+			if isDownload(cmd.args) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// analyzeGit flags git subcommands that discard history or local work
+func analyzeGit(args []string, a *RiskAssessment) {
+	if len(args) == 0 {
+		return
+	}
+	_, flags := splitFlags(args[1:])
+	switch args[0] {
+	case "push":
+		if hasFlag(flags, "f", "force", "force-with-lease") {
+			a.raise(RiskMedium, "force-pushes git history")
+		}
+	case "reset":
+		if hasFlag(flags, "hard") {
+			a.raise(RiskMedium, "discards uncommitted git changes")
+		}
+	case "clean":
+		if hasFlag(flags, "f", "force") {
+			a.raise(RiskMedium, "deletes untracked files")
+		}
+	}
+}
+
+// analyzeRedirect checks where output redirections write to
+func analyzeRedirect(r redirect, workingDir string, a *RiskAssessment) {
+	if r.op == "<" || r.target == "" || strings.HasPrefix(r.target, "&") {
+		return
+	}
+	path := resolvePath(r.target, workingDir)
+	if harmlessDevices[path] {
+		return
+	}
+	if strings.HasPrefix(path, "/dev/") {
+		a.raise(RiskHigh, "writes directly to device "+path)
+		return
+	}
+	if r.op != ">>" {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			a.raise(RiskMedium, "overwrites existing file "+r.target)
+		}
+	}
+	checkWriteTarget(r.target, workingDir, a)
+}
+
+// checkWriteTarget flags writes that land outside the working directory
+func checkWriteTarget(target string, workingDir string, a *RiskAssessment) {
+	path := resolvePath(target, workingDir)
+	if harmlessDevices[path] || workingDir == "" {
+		return
+	}
+	for _, sys := range systemPaths {
+		if path == sys || strings.HasPrefix(path, sys+"/") {
+			a.raise(RiskHigh, "writes to system path "+path)
+			return
+		}
+	}
+	if isWithin(path, workingDir) || isWithin(path, os.TempDir()) || isWithin(path, "/tmp") {
+		return
+	}
+	a.raise(RiskMedium, "writes outside the working directory: "+path)
+}
+
+// isCriticalPath reports whether deleting the target would be catastrophic
+func isCriticalPath(target string, workingDir string) bool {
+	switch target {
+	case "/", "/*", "~", "~/", "~/*", "*", ".", "..", "./*", "$HOME", "${HOME}":
+		return true
+	}
+	path := resolvePath(target, workingDir)
+	homeDir, _ := os.UserHomeDir()
+	return path == "/" || (homeDir != "" && path == homeDir)
+}
+
+// resolvePath turns a command argument into an absolute, cleaned path
+func resolvePath(target string, workingDir string) string {
+	if target == "~" || strings.HasPrefix(target, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			target = filepath.Join(homeDir, strings.TrimPrefix(target, "~"))
+		}
+	}
+	for _, v := range []string{"$HOME", "${HOME}"} {
+		if strings.HasPrefix(target, v) {
+			if homeDir, err := os.UserHomeDir(); err == nil {
+				target = homeDir + strings.TrimPrefix(target, v)
+			}
+		}
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(workingDir, target)
+	}
+	return filepath.Clean(target)
+}
+
+// isWithin reports whether path is dir or a descendant of it
+func isWithin(path string, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, "../"))
+}
+
+// stripCommandPrefixes removes env assignments and wrapper commands such as sudo
+func stripCommandPrefixes(args []string, a *RiskAssessment) []string {
+	for len(args) > 0 {
+		name := filepath.Base(args[0])
+		switch {
+		case isAssignment(args[0]):
+			args = args[1:]
+		case name == "sudo" || name == "doas" || name == "su":
+			a.raise(RiskHigh, "runs with elevated privileges via "+name)
+			args = args[1:]
+			for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+				if args[0] == "-u" || args[0] == "-g" {
+					args = args[1:]
+				}
+				if len(args) > 0 {
+					args = args[1:]
+				}
+			}
+		case name == "env" || name == "nohup" || name == "time" || name == "nice" || name == "command" || name == "exec" || name == "builtin":
+			args = args[1:]
+			for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+				args = args[1:]
+			}
+		default:
+			return args
+		}
+	}
+	return args
+}
+
+// isAssignment reports whether a word is a NAME=value prefix
+func isAssignment(word string) bool {
+	eq := strings.Index(word, "=")
+	if eq <= 0 {
+		return false
+	}
+	for i, r := range word[:eq] {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitFlags separates option arguments from operands
+func splitFlags(args []string) (operands []string, flags []string) {
+	endOfFlags := false
+	for _, arg := range args {
+		if !endOfFlags && arg == "--" {
+			endOfFlags = true
+			continue
+		}
+		if !endOfFlags && strings.HasPrefix(arg, "-") && arg != "-" {
+			flags = append(flags, arg)
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return operands, flags
+}
+
+// hasFlag reports whether any short (single letter) or long flag is present
+func hasFlag(flags []string, names ...string) bool {
+	for _, f := range flags {
+		for _, n := range names {
+			if len(n) == 1 {
+				if !strings.HasPrefix(f, "--") && strings.Contains(f[1:], n) {
+					return true
+				}
+			} else if f == "--"+n || strings.HasPrefix(f, "--"+n+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// xargsValueFlags are the xargs options that take a value, given attached or
+// as the next argument
+var xargsValueFlags = map[string]bool{
+	"a": true, "d": true, "E": true, "I": true, "L": true, "n": true, "P": true, "s": true,
+	"--arg-file": true, "--delimiter": true, "--max-args": true, "--max-procs": true,
+	"--max-chars": true, "--process-slot-var": true,
+}
+
+// xargsCommand returns the command xargs runs, skipping only the options of
+// xargs itself so that the command keeps its own flags
+func xargsCommand(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return args[i+1:]
+		case strings.HasPrefix(arg, "--"):
+			if xargsValueFlags[arg] {
+				i++
+			}
+		case len(arg) > 1 && arg[0] == '-':
+			for j := 1; j < len(arg); j++ {
+				if xargsValueFlags[arg[j:j+1]] {
+					// The rest of the word is the value, or else the next argument
+					if j+1 == len(arg) {
+						i++
+					}
+					break
+				}
+			}
+		default:
+			return args[i:]
+		}
+	}
+	return nil
+}
+
+// findExecArgs returns the command given to find -exec, up to its terminator
+func findExecArgs(args []string) []string {
+	for i, arg := range args {
+		if arg == ";" || arg == `\;` || arg == "+" {
+			return args[:i]
+		}
+	}
+	return args
+}
+
+// parseCommandLine returns the simple commands in command, followed by those
+// run by its command and process substitutions
+func parseCommandLine(command string) []*simpleCommand {
+	commands := parseShellCommands(tokenizeShell(command))
+	for _, sub := range commandSubstitutions(command) {
+		commands = append(commands, parseCommandLine(sub)...)
+	}
+	return commands
+}
+
+// commandSubstitutions returns the commands inside the $(...), `...`, <(...)
+// and >(...) substitutions of command that the shell would run, which are
+// those outside single quotes. Arithmetic $((...)) is not a substitution.
+func commandSubstitutions(command string) []string {
+	var subs []string
+	runes := []rune(command)
+	inDouble := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case r == '\\':
+			i++
+		case r == '\'' && !inDouble:
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+			}
+		case r == '"':
+			inDouble = !inDouble
+		case r == '`':
+			end := substitutionEnd(runes, i)
+			subs = append(subs, string(runes[i+1:min(end, len(runes))]))
+			i = end
+		case next == '(' && (r == '$' || (!inDouble && (r == '<' || r == '>'))):
+			end := substitutionEnd(runes, i+1)
+			if r != '$' || i+2 >= len(runes) || runes[i+2] != '(' {
+				subs = append(subs, string(runes[i+2:min(end, len(runes))]))
+			}
+			i = end
+		}
+	}
+	return subs
+}
+
+// substitutionEnd returns the index of the backquote or parenthesis that
+// closes the one at runes[open], or len(runes) if it isn't closed
+func substitutionEnd(runes []rune, open int) int {
+	if runes[open] == '`' {
+		for i := open + 1; i < len(runes); i++ {
+			if runes[i] == '\\' {
+				i++
+			} else if runes[i] == '`' {
+				return i
+			}
+		}
+		return len(runes)
+	}
+	depth := 0
+	for i := open; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			i++
+		case '\'', '"':
+			quote := runes[i]
+			for i++; i < len(runes) && runes[i] != quote; i++ {
+				if quote == '"' && runes[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(runes)
+}
+
+// parseShellCommands groups tokens into simple commands, linking pipelines
+func parseShellCommands(tokens []shellToken) []*simpleCommand {
+	var commands []*simpleCommand
+	current := &simpleCommand{}
+	flush := func(piped bool) {
+		if len(current.args) > 0 || len(current.redirects) > 0 {
+			commands = append(commands, current)
+		}
+		next := &simpleCommand{}
+		if piped {
+			next.pipedFrom = current
+		}
+		current = next
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if !tok.op {
+			current.args = append(current.args, tok.text)
+			continue
+		}
+		switch tok.text {
+		case "|":
+			flush(true)
+		case ">", ">>", ">|", "&>", "<":
+			r := redirect{op: tok.text}
+			if i+1 < len(tokens) && !tokens[i+1].op {
+				r.target = tokens[i+1].text
+				i++
+			}
+			current.redirects = append(current.redirects, r)
+		default:
+			flush(false)
+		}
+	}
+	flush(false)
+	return commands
+}
+
+// tokenizeShell splits a command line into words and control operators.
+// It understands quoting well enough for risk analysis but does not perform
+// expansions; command and process substitutions are kept whole as part of
+// a word and left to commandSubstitutions.
+func tokenizeShell(command string) []shellToken {
+	var tokens []shellToken
+	var word strings.Builder
+	inWord := false
+	emitWord := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{text: word.String()})
+			word.Reset()
+			inWord = false
+		}
+	}
+	emitOp := func(op string) {
+		emitWord()
+		tokens = append(tokens, shellToken{text: op, op: true})
+	}
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case r == '\\' && next != 0:
+			word.WriteRune(next)
+			inWord = true
+			i++
+		case r == '\'':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word.WriteRune(runes[i])
+			}
+		case r == '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				word.WriteRune(runes[i])
+			}
+		case r == '`' || (next == '(' && (r == '$' || r == '<' || r == '>')):
+			start := i
+			if r != '`' {
+				i++
+			}
+			i = min(substitutionEnd(runes, i), len(runes)-1)
+			word.WriteString(string(runes[start : i+1]))
+			inWord = true
+		case r == '#' && !inWord:
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			i--
+		case r == ' ' || r == '\t':
+			emitWord()
+		case r == '\n' || r == ';' || r == '(' || r == ')':
+			emitOp(";")
+		case r == '|':
+			if next == '|' {
+				emitOp("||")
+				i++
+			} else {
+				emitOp("|")
+			}
+		case r == '&':
+			if next == '&' {
+				emitOp("&&")
+				i++
+			} else if next == '>' {
+				emitOp("&>")
+				i++
+				if i+1 < len(runes) && runes[i+1] == '>' {
+					i++
+				}
+			} else {
+				emitOp("&")
+			}
+		case r == '>':
+			if inWord && isFileDescriptor(word.String()) {
+				word.Reset()
+				inWord = false
+			}
+			op := ">"
+			if next == '>' || next == '|' {
+				op += string(next)
+				i++
+			}
+			if i+1 < len(runes) && runes[i+1] == '&' {
+				// fd duplication such as 2>&1 does not write to a file
+				emitWord()
+				for i++; i+1 < len(runes) && (isFileDescriptor(string(runes[i+1])) || runes[i+1] == '-'); i++ {
+				}
+				continue
+			}
+			emitOp(op)
+		case r == '<':
+			if inWord && isFileDescriptor(word.String()) {
+				word.Reset()
+				inWord = false
+			}
+			emitOp("<")
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	emitWord()
+	return tokens
+}
+
+// isFileDescriptor reports whether a word is a numeric fd prefix like the 2 in 2>
+func isFileDescriptor(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
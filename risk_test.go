@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeRisk(t *testing.T) {
+	workingDir := t.TempDir()
+	tests := []struct {
+		command string
+		want    RiskLevel
+		reason  string
+	}{
+		{"ls -la", RiskLow, ""},
+		{"grep -r TODO . | sort | uniq -c", RiskLow, ""},
+		{"find . -name '*.tmp' -exec rm {} \\;", RiskMedium, "deletes files"},
+		{"rm notes.txt", RiskMedium, "deletes files"},
+		{"rm -rf build", RiskHigh, "recursively deletes files"},
+		{"rm -rf /", RiskHigh, "deletes /"},
+		{"sudo apt-get update", RiskHigh, "runs with elevated privileges via sudo"},
+		{"dd if=/dev/zero of=/dev/sda", RiskHigh, "raw disk copy with dd"},
+		{"echo hi > /dev/sda", RiskHigh, "writes directly to device /dev/sda"},
+		{"echo hi > /dev/null", RiskLow, ""},
+		{"chmod -R 777 .", RiskHigh, "recursively changes ownership or permissions"},
+		{"git push --force", RiskMedium, "force-pushes git history"},
+		{"bash -c 'rm -rf build'", RiskHigh, "recursively deletes files"},
+		{":(){ :|:& };:", RiskHigh, "fork bomb"},
+		{"mv ~/important /dev/null", RiskHigh, "moves or copies onto device /dev/null"},
+		{"cp backup.img /dev/sdb", RiskHigh, "moves or copies onto device /dev/sdb"},
+		{"grep -v x log | tee /dev/null", RiskLow, ""},
+
+		// Commands run by xargs keep their own flags
+		{"find . -name '*.log' -print0 | xargs -0 rm -rf", RiskHigh, "recursively deletes files"},
+		{"ls | xargs -I{} rm -rf /{}", RiskHigh, "recursively deletes files"},
+		{"ls | xargs -I {} rm -rf {}", RiskHigh, "recursively deletes files"},
+		{"ls | xargs -n 1 -P4 chmod -R 777", RiskHigh, "recursively changes ownership or permissions"},
+		{"ls | xargs -d '\\n' --max-procs 2 rm -r", RiskHigh, "recursively deletes files"},
+		{"ls | xargs -0rt -- rm -f", RiskMedium, "deletes files"},
+		{"ls | xargs wc -l", RiskLow, ""},
+
+		// Downloaded code run by an interpreter
+		{"curl -fsSL https://example.com/install.sh | sh", RiskHigh, "pipes downloaded content into sh"},
+		{"curl -fsSL https://example.com/install.sh | sh -s -- --yes", RiskHigh, "pipes downloaded content into sh"},
+		{"curl https://example.com/install.sh | bash -", RiskHigh, "pipes downloaded content into bash"},
+		{"curl https://example.com/install.sh | bash -x", RiskHigh, "pipes downloaded content into bash"},
+		{"wget -qO- https://example.com/get.py | python3 -", RiskHigh, "pipes downloaded content into python3"},
+		{"curl -s https://example.com/x | sudo bash", RiskHigh, "pipes downloaded content into bash"},
+		{"bash <(curl -fsSL https://example.com/install.sh)", RiskHigh, "runs downloaded content with bash"},
+		{"bash < <(curl -fsSL https://example.com/install.sh)", RiskHigh, "runs downloaded content with bash"},
+		{`/bin/bash -c "$(curl -fsSL https://example.com/install.sh)"`, RiskHigh, "runs downloaded content with bash"},
+		{"eval \"$(curl -s https://example.com/env)\"", RiskHigh, "runs downloaded content with eval"},
+		{"source <(curl -s https://example.com/env)", RiskHigh, "runs downloaded content with source"},
+		{"cat script.sh | bash", RiskMedium, "pipes data into bash for execution"},
+
+		// Data piped into an interpreter running a script of its own
+		{"curl -s https://example.com/data.json | python3 -c 'import json,sys; print(json.load(sys.stdin))'", RiskLow, ""},
+		{"curl -s https://example.com/data.txt | perl -ne 'print if /x/'", RiskLow, ""},
+		{"curl -s https://example.com/data.txt | bash process.sh", RiskLow, ""},
+
+		// Commands run by substitutions
+		{"echo `rm -rf /`", RiskHigh, "deletes /"},
+		{"echo \"today is $(date)\"", RiskLow, ""},
+		{"echo \"$(rm -rf build)\"", RiskHigh, "recursively deletes files"},
+		{"diff <(sort a.txt) <(rm -rf build)", RiskHigh, "recursively deletes files"},
+		{"echo '$(rm -rf build)'", RiskLow, ""},
+		{"echo $((1 + 2))", RiskLow, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got := AnalyzeRisk(tt.command, workingDir)
+			if got.Level != tt.want {
+				t.Errorf("AnalyzeRisk(%q) level = %s (%s), want %s", tt.command, got.Level, strings.Join(got.Reasons, "; "), tt.want)
+			}
+			if tt.reason != "" && !containsString(got.Reasons, tt.reason) {
+				t.Errorf("AnalyzeRisk(%q) reasons = %q, want %q among them", tt.command, got.Reasons, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCommandSubstitutions(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"ls", nil},
+		{"echo $(date)", []string{"date"}},
+		{"echo `whoami`", []string{"whoami"}},
+		{"echo \"$(cat \"a b\")\"", []string{`cat "a b"`}},
+		{"diff <(sort a) >(tee b)", []string{"sort a", "tee b"}},
+		{"echo $(echo $(pwd))", []string{"echo $(pwd)"}},
+		{"echo '$(date)' \"<(x)\"", nil},
+		{"echo $((1 + 2))", nil},
+	}
+	for _, tt := range tests {
+		if got := commandSubstitutions(tt.command); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("commandSubstitutions(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Shell snippets printed by `uc init`. Each defines a widget that sends the
+// current command line to uc in print mode and replaces it with the generated
+// command, which the user can then edit or run with Enter. The %s verb
+// receives the quoted uc invocation.
+
+const bashInit = `# uc keybinding for bash: add  eval "$(uc init bash)"  to ~/.bashrc
+__uc_widget() {
+    local request=$READLINE_LINE
+    [[ -z $request ]] && return
+    local cmd
+    cmd=$(%s -print -yes -- "$request" </dev/tty) || return
+    READLINE_LINE=$cmd
+    READLINE_POINT=${#READLINE_LINE}
+}
+bind -x '"\C-g": __uc_widget'
+`
+
+const zshInit = `# uc keybinding for zsh: add  eval "$(uc init zsh)"  to ~/.zshrc
+__uc_widget() {
+    local request=$BUFFER
+    [[ -z $request ]] && return
+    local cmd
+    zle -I
+    if cmd=$(%s -print -yes -- "$request" </dev/tty); then
+        BUFFER=$cmd
+        CURSOR=${#BUFFER}
+    fi
+    zle reset-prompt
+}
+zle -N __uc_widget
+bindkey '^G' __uc_widget
+`
+
+const fishInit = `# uc keybinding for fish: add  uc init fish | source  to ~/.config/fish/config.fish
+function __uc_widget
+    set -l request (commandline)
+    if test -z "$request"
+        return
+    end
+    set -l cmd (%s -print -yes -- "$request" </dev/tty)
+    and commandline -r -- (string join \n -- $cmd)
+    commandline -f repaint
+end
+bind \cg __uc_widget
+bind -M insert \cg __uc_widget
+`
+
+// shellInitScripts maps shell names to their `uc init` snippet
+var shellInitScripts = map[string]string{
+	"bash": bashInit,
+	"zsh":  zshInit,
+	"fish": fishInit,
+}
+
+// runInit prints the keybinding snippet for shell, or for the user's login
+// shell if shell is empty. configPath is passed on to the widget if set.
+func runInit(shell string, configPath string) int {
+	if shell == "" {
+		shell = filepath.Base(os.Getenv("SHELL"))
+	}
+	script, ok := shellInitScripts[shell]
+	if !ok {
+		printError("Usage: uc init bash|zsh|fish")
+		return ExitUsage
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = "uc"
+	}
+	invocation := []string{shellescape(self)}
+	if configPath != "" {
+		if abs, err := filepath.Abs(configPath); err == nil {
+			configPath = abs
+		}
+		invocation = append(invocation, "-config", shellescape(configPath))
+	}
+
+	fmt.Printf(script, strings.Join(invocation, " "))
+	return ExitOK
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// stateDumpArg is the hidden argument that makes uc write its working
+// directory and environment to a file. The executor runs it from the shell's
+// EXIT trap to capture state without parsing the command's output.
+const stateDumpArg = "__uc_dump_state"
+
+// Variables that change on every shell invocation and are never tracked
+var volatileEnvVars = map[string]bool{
+	"_": true, "PWD": true, "SHLVL": true,
+}
+
+// shellDialect describes how to list shell-local state in a given shell
+type shellDialect struct {
+	// aliases lists aliases as code that redefines them
+	aliases string
+	// functions lists function definitions; empty if the shell can't
+	functions string
+	// prelude is run before restoring state
+	prelude string
+}
+
+// Shell-specific commands for capturing aliases and functions
+var shellDialects = map[string]shellDialect{
+	"bash": {aliases: "alias -p", functions: "declare -f", prelude: "shopt -s expand_aliases"},
+	"zsh":  {aliases: "alias -L", functions: "typeset -f"},
+	"sh":   {aliases: "alias"},
+}
+
+// shellKind maps a shell path to a key of shellDialects
+func shellKind(shell string) string {
+	switch name := filepath.Base(shell); name {
+	case "bash", "zsh":
+		return name
+	default:
+		return "sh"
+	}
+}
+
+// SessionState maintains state between command executions
+type SessionState struct {
+	WorkingDir string
+	// EnvVars holds variables whose value differs from the baseline
+	EnvVars map[string]string
+	// Unset holds baseline variables that a command removed
+	Unset map[string]bool
+
+	// Shell-local state replayed before each command
+	Aliases   string
+	Functions string
+	Options   string
+	Umask     string
+
+	baseline map[string]string
+	// shell is the persistent shell coprocess, if one is running
+	shell *persistentShell
+}
+
+// NewSessionState creates a new session state
+func NewSessionState() *SessionState {
+	wd, _ := os.Getwd()
+	return &SessionState{
+		WorkingDir: wd,
+		EnvVars:    make(map[string]string),
+		Unset:      make(map[string]bool),
+		baseline:   parseEnviron(os.Environ()),
+	}
+}
+
+// Environ returns the environment a command should run with: the baseline
+// environment minus unset variables, plus tracked changes
+func (s *SessionState) Environ() []string {
+	env := make([]string, 0, len(s.baseline)+len(s.EnvVars))
+	for k, v := range s.baseline {
+		if s.Unset[k] {
+			continue
+		}
+		if _, changed := s.EnvVars[k]; changed {
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+	for k, v := range s.EnvVars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// captureScript returns shell code that writes the working directory and
+// environment to envFile and the aliases, functions, options and umask to
+// shellFile
+func captureScript(kind string, envFile string, shellFile string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	dialect := shellDialects[kind]
+	functions := dialect.functions
+	if functions == "" {
+		functions = ":"
+	}
+	return fmt.Sprintf("{ %s; printf '\\0'; %s; printf '\\0'; set +o; printf '\\0'; umask; } > %s 2>/dev/null\n%s %s %s",
+		dialect.aliases, functions, shellescape(shellFile),
+		shellescape(self), stateDumpArg, shellescape(envFile)), nil
+}
+
+// captureTrap returns shell code that runs captureScript when the shell
+// exits, including when the command calls exit
+func captureTrap(kind string, envFile string, shellFile string) (string, error) {
+	body, err := captureScript(kind, envFile, shellFile)
+	if err != nil {
+		return "", err
+	}
+	return "trap " + shellescape(body) + " EXIT", nil
+}
+
+// restoreScript returns shell code that replays captured shell-local state
+func (s *SessionState) restoreScript(kind string) string {
+	var script strings.Builder
+	if prelude := shellDialects[kind].prelude; prelude != "" {
+		script.WriteString(prelude + "\n")
+	}
+	if s.Options != "" {
+		script.WriteString(s.Options + "\n")
+	}
+	if s.Umask != "" {
+		script.WriteString("umask " + s.Umask + "\n")
+	}
+	if s.Aliases != "" {
+		script.WriteString(s.Aliases + "\n")
+	}
+	if s.Functions != "" {
+		script.WriteString(s.Functions + "\n")
+	}
+	return script.String()
+}
+
+// loadShellState reads the aliases, functions, options and umask written by
+// the capture trap
+func (s *SessionState) loadShellState(file string, kind string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sections := strings.Split(string(data), "\x00")
+	if len(sections) != 4 {
+		return fmt.Errorf("incomplete shell state")
+	}
+
+	aliases := strings.TrimSpace(sections[0])
+	if kind == "sh" && aliases != "" {
+		// POSIX sh lists aliases as name=value without the alias keyword
+		lines := strings.Split(aliases, "\n")
+		for i, line := range lines {
+			if !strings.HasPrefix(line, "alias ") {
+				lines[i] = "alias " + line
+			}
+		}
+		aliases = strings.Join(lines, "\n")
+	}
+	s.Aliases = aliases
+	s.Functions = strings.TrimSpace(sections[1])
+	s.Options = withoutMonitor(strings.TrimSpace(sections[2]))
+	s.Umask = strings.TrimSpace(sections[3])
+	return nil
+}
+
+// withoutMonitor drops the job control setting from captured shell options;
+// uc decides whether a shell runs with job control
+func withoutMonitor(options string) string {
+	var kept []string
+	for _, line := range strings.Split(options, "\n") {
+		if fields := strings.Fields(line); len(fields) == 0 || fields[len(fields)-1] != "monitor" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// dumpState writes the current working directory and environment to file as
+// NUL-delimited records; it is the other end of captureTrap
+func dumpState(file string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(wd)
+	for _, kv := range os.Environ() {
+		buf.WriteByte(0)
+		buf.WriteString(kv)
+	}
+	return os.WriteFile(file, buf.Bytes(), 0600)
+}
+
+// loadState reads a file written by dumpState and updates the session
+func (s *SessionState) loadState(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("no state captured")
+	}
+
+	records := strings.Split(string(data), "\x00")
+	if wd := records[0]; filepath.IsAbs(wd) {
+		s.WorkingDir = wd
+	}
+	s.updateEnvVars(parseEnviron(records[1:]))
+	return nil
+}
+
+// updateEnvVars diffs the environment a command ended with against the
+// baseline, tracking only variables the session has changed or removed
+func (s *SessionState) updateEnvVars(env map[string]string) {
+	for k, v := range env {
+		if volatileEnvVars[k] {
+			continue
+		}
+		delete(s.Unset, k)
+		if base, ok := s.baseline[k]; ok && base == v {
+			delete(s.EnvVars, k)
+		} else {
+			s.EnvVars[k] = v
+		}
+	}
+
+	for k := range s.EnvVars {
+		if _, ok := env[k]; !ok {
+			delete(s.EnvVars, k)
+		}
+	}
+	for k := range s.baseline {
+		if _, ok := env[k]; !ok && !volatileEnvVars[k] {
+			s.Unset[k] = true
+		}
+	}
+}
+
+// parseEnviron converts KEY=value entries into a map
+func parseEnviron(entries []string) map[string]string {
+	env := make(map[string]string, len(entries))
+	for _, kv := range entries {
+		if k, v, ok := strings.Cut(kv, "="); ok && k != "" {
+			env[k] = v
+		}
+	}
+	return env
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testBaseline is the environment uc started with in the state tests
+var testBaseline = map[string]string{
+	"HOME":  "/home/user",
+	"PATH":  "/usr/bin:/bin",
+	"LANG":  "C",
+	"SHLVL": "1",
+	"PWD":   "/home/user",
+}
+
+// newTestState returns a session with testBaseline and the given changes
+func newTestState(envVars map[string]string, unset ...string) *SessionState {
+	s := &SessionState{EnvVars: make(map[string]string), Unset: make(map[string]bool), baseline: testBaseline}
+	for k, v := range envVars {
+		s.EnvVars[k] = v
+	}
+	for _, k := range unset {
+		s.Unset[k] = true
+	}
+	return s
+}
+
+// withBaseline returns testBaseline with the given variables changed, added
+// or, if their value is "<unset>", removed
+func withBaseline(changes map[string]string) map[string]string {
+	env := make(map[string]string)
+	for k, v := range testBaseline {
+		env[k] = v
+	}
+	for k, v := range changes {
+		if v == "<unset>" {
+			delete(env, k)
+		} else {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func TestUpdateEnvVars(t *testing.T) {
+	tests := []struct {
+		name string
+		// before and unset are the session's changes before the command
+		before    map[string]string
+		unset     []string
+		env       map[string]string
+		want      map[string]string
+		wantUnset []string
+	}{
+		{
+			name: "unchanged environment",
+			env:  withBaseline(nil),
+			want: map[string]string{},
+		},
+		{
+			name: "new and changed variables",
+			env:  withBaseline(map[string]string{"FOO": "bar", "PATH": "/opt/bin:/usr/bin:/bin"}),
+			want: map[string]string{"FOO": "bar", "PATH": "/opt/bin:/usr/bin:/bin"},
+		},
+		{
+			name: "multi-line value and value containing =",
+			env:  withBaseline(map[string]string{"CERT": "line one\nline two\n", "OPTS": "-Dkey=value=x"}),
+			want: map[string]string{"CERT": "line one\nline two\n", "OPTS": "-Dkey=value=x"},
+		},
+		{
+			name:   "variable set back to its baseline value",
+			before: map[string]string{"LANG": "en_US.UTF-8", "FOO": "bar"},
+			env:    withBaseline(map[string]string{"FOO": "bar"}),
+			want:   map[string]string{"FOO": "bar"},
+		},
+		{
+			name:      "baseline variable unset",
+			env:       withBaseline(map[string]string{"LANG": "<unset>"}),
+			want:      map[string]string{},
+			wantUnset: []string{"LANG"},
+		},
+		{
+			name:      "changed baseline variable unset",
+			before:    map[string]string{"LANG": "en_US.UTF-8"},
+			env:       withBaseline(map[string]string{"LANG": "<unset>"}),
+			want:      map[string]string{},
+			wantUnset: []string{"LANG"},
+		},
+		{
+			name:   "new variable unset",
+			before: map[string]string{"FOO": "bar"},
+			env:    withBaseline(nil),
+			want:   map[string]string{},
+		},
+		{
+			name:  "unset variable set again",
+			unset: []string{"LANG"},
+			env:   withBaseline(map[string]string{"LANG": "fr_FR.UTF-8"}),
+			want:  map[string]string{"LANG": "fr_FR.UTF-8"},
+		},
+		{
+			name:  "unset variable set back to its baseline value",
+			unset: []string{"LANG"},
+			env:   withBaseline(nil),
+			want:  map[string]string{},
+		},
+		{
+			name:      "unset variable stays unset",
+			unset:     []string{"LANG"},
+			env:       withBaseline(map[string]string{"LANG": "<unset>"}),
+			want:      map[string]string{},
+			wantUnset: []string{"LANG"},
+		},
+		{
+			name: "volatile variables",
+			env:  withBaseline(map[string]string{"PWD": "/tmp", "SHLVL": "<unset>", "_": "/usr/bin/env"}),
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(tt.before, tt.unset...)
+			s.updateEnvVars(tt.env)
+			if !reflect.DeepEqual(s.EnvVars, tt.want) {
+				t.Errorf("EnvVars = %q, want %q", s.EnvVars, tt.want)
+			}
+			wantUnset := make(map[string]bool)
+			for _, k := range tt.wantUnset {
+				wantUnset[k] = true
+			}
+			if !reflect.DeepEqual(s.Unset, wantUnset) {
+				t.Errorf("Unset = %v, want %v", s.Unset, wantUnset)
+			}
+		})
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	s := newTestState(map[string]string{"PATH": "/opt/bin", "FOO": "a=b\nc"}, "LANG")
+	want := []string{"FOO=a=b\nc", "HOME=/home/user", "PATH=/opt/bin", "PWD=/home/user", "SHLVL=1"}
+	if got := s.Environ(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Environ = %q, want %q", got, want)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantDir string
+		want    map[string]string
+		err     bool
+	}{
+		{
+			name:    "working directory and environment",
+			data:    "/tmp/work\x00HOME=/home/user\x00PATH=/usr/bin:/bin\x00SHLVL=2\x00PWD=/tmp/work\x00CERT=line one\nline two\x00OPTS=a=b=c\x00EMPTY=",
+			wantDir: "/tmp/work",
+			want:    map[string]string{"CERT": "line one\nline two", "OPTS": "a=b=c", "EMPTY": ""},
+		},
+		{
+			name:    "relative working directory",
+			data:    "work\x00HOME=/home/user\x00PATH=/usr/bin:/bin\x00LANG=C",
+			wantDir: "/start",
+			want:    map[string]string{},
+		},
+		{
+			name:    "entries without a name",
+			data:    "/tmp\x00HOME=/home/user\x00PATH=/usr/bin:/bin\x00LANG=C\x00=x\x00junk",
+			wantDir: "/tmp",
+			want:    map[string]string{},
+		},
+		{
+			name:    "nothing captured",
+			data:    "",
+			wantDir: "/start",
+			want:    map[string]string{},
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "env")
+			if err := os.WriteFile(file, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestState(nil)
+			s.WorkingDir = "/start"
+			if err := s.loadState(file); (err != nil) != tt.err {
+				t.Errorf("loadState error = %v, want error %t", err, tt.err)
+			}
+			if s.WorkingDir != tt.wantDir {
+				t.Errorf("WorkingDir = %q, want %q", s.WorkingDir, tt.wantDir)
+			}
+			if !reflect.DeepEqual(s.EnvVars, tt.want) {
+				t.Errorf("EnvVars = %q, want %q", s.EnvVars, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadShellState(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+		data string
+		want SessionState
+		err  bool
+	}{
+		{
+			name: "bash",
+			kind: "bash",
+			data: "alias ll='ls -l'\n\x00greet () \n{ \n    echo hi\n}\n\x00set -o emacs\nset +o monitor\nset -o noclobber\n\x000022\n",
+			want: SessionState{Aliases: "alias ll='ls -l'", Functions: "greet () \n{ \n    echo hi\n}", Options: "set -o emacs\nset -o noclobber", Umask: "0022"},
+		},
+		{
+			name: "sh aliases without the alias keyword",
+			kind: "sh",
+			data: "ll='ls -l'\nla='ls -A'\n\x00\x00set -o monitor\nset +o noglob\n\x000077\n",
+			want: SessionState{Aliases: "alias ll='ls -l'\nalias la='ls -A'", Options: "set +o noglob", Umask: "0077"},
+		},
+		{
+			name: "sh aliases with the alias keyword",
+			kind: "sh",
+			data: "alias ll='ls -l'\n\x00\x00\x000022",
+			want: SessionState{Aliases: "alias ll='ls -l'", Umask: "0022"},
+		},
+		{
+			name: "zsh options",
+			kind: "zsh",
+			data: "\x00\x00set -o monitor\nset -o autocd\n\x00022",
+			want: SessionState{Options: "set -o autocd", Umask: "022"},
+		},
+		{
+			name: "incomplete state",
+			kind: "bash",
+			data: "alias ll='ls -l'\x00",
+			want: SessionState{Aliases: "old"},
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "shell")
+			if err := os.WriteFile(file, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s := &SessionState{Aliases: "old"}
+			if err := s.loadShellState(file, tt.kind); (err != nil) != tt.err {
+				t.Errorf("loadShellState error = %v, want error %t", err, tt.err)
+			}
+			got := []string{s.Aliases, s.Functions, s.Options, s.Umask}
+			want := []string{tt.want.Aliases, tt.want.Functions, tt.want.Options, tt.want.Umask}
+			for i, field := range []string{"Aliases", "Functions", "Options", "Umask"} {
+				if got[i] != want[i] {
+					t.Errorf("%s = %q, want %q", field, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreScript(t *testing.T) {
+	s := &SessionState{Aliases: "alias ll='ls -l'", Options: "set -o noclobber", Umask: "0077"}
+	got := s.restoreScript("bash")
+	want := "shopt -s expand_aliases\nset -o noclobber\numask 0077\nalias ll='ls -l'\n"
+	if got != want {
+		t.Errorf("restoreScript = %q, want %q", got, want)
+	}
+	if got := s.restoreScript("sh"); strings.Contains(got, "shopt") {
+		t.Errorf("restoreScript for sh = %q, which uses a bash builtin", got)
+	}
+}
+
+func TestDumpStateRoundTrip(t *testing.T) {
+	t.Setenv("UC_TEST_CERT", "line one\nline two")
+	t.Setenv("UC_TEST_OPTS", "a=b=c")
+	s := NewSessionState()
+	os.Unsetenv("UC_TEST_OPTS")
+	t.Setenv("UC_TEST_NEW", "x\ny=z")
+
+	file := filepath.Join(t.TempDir(), "env")
+	if err := dumpState(file); err != nil {
+		t.Fatalf("dumpState failed: %v", err)
+	}
+	if err := s.loadState(file); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if want := map[string]string{"UC_TEST_NEW": "x\ny=z"}; !reflect.DeepEqual(s.EnvVars, want) {
+		t.Errorf("EnvVars = %q, want %q", s.EnvVars, want)
+	}
+	if want := map[string]bool{"UC_TEST_OPTS": true}; !reflect.DeepEqual(s.Unset, want) {
+		t.Errorf("Unset = %v, want %v", s.Unset, want)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/briandowns/spinner"
+	"golang.org/x/term"
+)
+
+// maxStreamLine limits the size of a single line of a streamed response
+const maxStreamLine = 1 << 20
+
+// previewPrefix labels the command while it is being generated
+const previewPrefix = "Generating: "
+
+var (
+	// errStreamDone is returned by an event handler to stop reading a stream
+	errStreamDone = errors.New("end of stream")
+	// errGenerationCancelled is returned when the user cancels generation
+	errGenerationCancelled = errors.New("generation cancelled")
+)
+
+// newStreamScanner returns a line scanner for a streamed response
+func newStreamScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+	return scanner
+}
+
+// readSSE calls onData with the data of each server-sent event read from r
+// until the stream ends. onData may return errStreamDone to stop early.
+func readSSE(r io.Reader, onData func(data string) error) error {
+	var data []string
+	dispatch := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		err := onData(strings.Join(data, "\n"))
+		data = nil
+		return err
+	}
+
+	scanner := newStreamScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := dispatch(); err != nil {
+				return ignoreStreamDone(err)
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ignoreStreamDone(dispatch())
+}
+
+// ignoreStreamDone treats errStreamDone as a normal end of the stream
+func ignoreStreamDone(err error) error {
+	if errors.Is(err, errStreamDone) {
+		return nil
+	}
+	return err
+}
+
+// commandResponse parses the text of a structured answer
+func commandResponse(text string, err error) (*CommandResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	return parseCommandResponse(text)
+}
+
+// commandResponses parses the text of several structured answers, skipping
+// unusable ones unless none of them can be used
+func commandResponses(texts []string, err error) ([]*CommandResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	var responses []*CommandResponse
+	for _, text := range texts {
+		response, err := parseCommandResponse(text)
+		if err != nil {
+			if len(texts) == 1 {
+				return nil, err
+			}
+			continue
+		}
+		responses = append(responses, response)
+	}
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("LLM returned no usable command")
+	}
+	return responses, nil
+}
+
+// single returns a lone answer as the result of a generateFunc
+func single(response *CommandResponse, err error) ([]*CommandResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	return []*CommandResponse{response}, nil
+}
+
+// generateFunc asks the LLM for one or more candidate commands, streaming
+// the raw response to onText if the client supports it
+type generateFunc func(ctx context.Context, onText func(string)) ([]*CommandResponse, error)
+
+// generateWithPreview runs generate behind a spinner that gives way to the
+// command as it streams in. Ctrl-C cancels generation.
+func generateWithPreview(message string, generate generateFunc) ([]*CommandResponse, error) {
+	ctx, stop := commandContext(0)
+	defer stop()
+
+	s := createSpinner(message)
+	s.Start()
+	preview := &commandPreview{spinner: s, out: os.Stderr, enabled: isTerminal(os.Stderr)}
+	responses, err := generate(ctx, preview.add)
+	preview.finish()
+
+	if errors.Is(context.Cause(ctx), errCommandInterrupted) {
+		return nil, errGenerationCancelled
+	}
+	return responses, err
+}
+
+// commandPreview shows the command being generated on a single terminal
+// line, replacing the spinner once the first characters arrive
+type commandPreview struct {
+	mu      sync.Mutex
+	spinner *spinner.Spinner
+	out     *os.File
+	enabled bool
+	done    bool
+	raw     strings.Builder
+	shown   string
+}
+
+// add records a piece of the raw response and redraws the command if it
+// changed
+func (p *commandPreview) add(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done || !p.enabled {
+		return
+	}
+	p.raw.WriteString(text)
+	command := partialCommand(p.raw.String())
+	if command == p.shown {
+		return
+	}
+	if p.shown == "" {
+		p.spinner.Stop()
+	}
+	p.shown = command
+
+	width := 80
+	if w, _, err := term.GetSize(int(p.out.Fd())); err == nil && w > 0 {
+		width = w
+	}
+	// Keep the end of long commands in view so the line never wraps
+	display := command
+	if max := width - len(previewPrefix) - 1; max > 1 && utf8.RuneCountInString(display) > max {
+		runes := []rune(display)
+		display = "…" + string(runes[len(runes)-max+1:])
+	}
+	fmt.Fprint(p.out, "\r\033[K")
+	colorInfo.Fprint(p.out, previewPrefix)
+	colorCommand.Fprint(p.out, display)
+}
+
+// finish stops the spinner and clears the preview line
+func (p *commandPreview) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	p.spinner.Stop()
+	if p.shown != "" {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+// partialCommand extracts the command from the start of a JSON answer that
+// may still be incomplete, showing newlines and tabs as spaces. Answers that
+// are not JSON are shown as their first line.
+func partialCommand(raw string) string {
+	trimmed := strings.TrimLeft(raw, " \t\r\n`")
+	trimmed = strings.TrimPrefix(trimmed, "json")
+	trimmed = strings.TrimLeft(trimmed, " \t\r\n")
+	if trimmed == "" {
+		return ""
+	}
+	if !strings.HasPrefix(trimmed, "{") {
+		line, _, _ := strings.Cut(trimmed, "\n")
+		return strings.TrimRight(line, "`\r")
+	}
+
+	_, rest, found := strings.Cut(trimmed, `"command"`)
+	if !found {
+		return ""
+	}
+	rest = strings.TrimLeft(rest, " \t\r\n")
+	if !strings.HasPrefix(rest, ":") {
+		return ""
+	}
+	rest = strings.TrimLeft(rest[1:], " \t\r\n")
+	if !strings.HasPrefix(rest, `"`) {
+		return ""
+	}
+	rest = rest[1:]
+
+	// Decode the string up to its closing quote or as far as it has arrived
+	var b strings.Builder
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == '"':
+			return b.String()
+		case c != '\\':
+			b.WriteByte(c)
+		case i+1 >= len(rest):
+			return b.String()
+		default:
+			i++
+			switch rest[i] {
+			case 'n', 't', 'r':
+				b.WriteByte(' ')
+			case 'u':
+				if i+4 >= len(rest) {
+					return b.String()
+				}
+				if r, err := strconv.ParseUint(rest[i+1:i+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+				}
+				i += 4
+			default:
+				b.WriteByte(rest[i])
+			}
+		}
+	}
+	return b.String()
+}